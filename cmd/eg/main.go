@@ -5,6 +5,7 @@ import (
 	"log"
 
 	"github.com/awans/fresnel/encryptedfile"
+	"github.com/awans/fresnel/keys"
 	"github.com/docopt/docopt-go"
 	"github.com/steveyen/gkvlite"
 )
@@ -13,12 +14,11 @@ const usage = `eg
 
 Usage:
   eg write <filename> <key> <val>
-  eg read <filename> <key>`
+  eg read <filename> <key>
 
-var encKey = [32]byte{'0', '1', '2', '3', '4', '5', '6', '7', '8', '9',
-	'0', '1', '2', '3', '4', '5', '6', '7', '8', '9',
-	'0', '1', '2', '3', '4', '5', '6', '7', '8', '9',
-	'0', '1'}
+The key comes from FRESNEL_KEY_FILE, FRESNEL_KEY_SHARES (a file of key shares,
+one per line), FRESNEL_KEY (hex) or FRESNEL_PASSPHRASE, or else is prompted
+for.`
 
 func main() {
 	args, _ := docopt.Parse(usage, nil, true, "V0", false)
@@ -26,7 +26,10 @@ func main() {
 		filename := args["<filename>"].(string)
 		key := []byte(args["<key>"].(string))
 		val := []byte(args["<val>"].(string))
-		f, err := encryptedfile.Open(filename, encKey)
+		f, err := encryptedfile.OpenProvider(filename, keys.FromEnv())
+		if err != nil {
+			log.Fatal(err)
+		}
 		defer f.Close()
 
 		s, err := gkvlite.NewStore(f)
@@ -41,7 +44,7 @@ func main() {
 	if args["read"].(bool) {
 		filename := args["<filename>"].(string)
 		key := []byte(args["<key>"].(string))
-		f, err := encryptedfile.Open(filename, encKey)
+		f, err := encryptedfile.OpenProvider(filename, keys.FromEnv(), encryptedfile.ReadOnly())
 		if err != nil {
 			log.Fatal(err)
 		}
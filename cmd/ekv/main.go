@@ -7,8 +7,10 @@ import (
 	"log"
 	"os"
 	"path"
+	"time"
 
-	_ "github.com/awans/fresnel/ekv"
+	"github.com/awans/fresnel/ekv"
+	"github.com/awans/fresnel/keys"
 	"github.com/blevesearch/bleve"
 	"github.com/docopt/docopt-go"
 )
@@ -18,32 +20,103 @@ const usage = `ekv
 Usage:
   ekv index <json_file>
 	ekv search <query>
-	ekv clean`
+	ekv clean
+	ekv verify
+	ekv keys list
+	ekv keys revoke <provider_id>
+
+Each provider's index has its own key, kept in a registry under a master key.
+Revoking a provider destroys its key, leaving its index and every backup of it
+unreadable. Verify decrypts every page of each index, reporting any that are
+corrupt, truncated or under the wrong key, and exits nonzero if it finds any.
+The master key comes from FRESNEL_KEY_FILE, FRESNEL_KEY_SHARES (a file of key
+shares, one per line), FRESNEL_KEY (hex) or FRESNEL_PASSPHRASE, or else is
+prompted for. New indexes are encrypted with the cipher suite named by
+FRESNEL_CIPHER: xchacha20-poly1305 (the default), aes-256-gcm or
+aes-256-gcm-siv, and compressed with FRESNEL_COMPRESSION: none (the default),
+snappy or flate.`
 
 const indexDir = "index"
-var pad = []byte("lorem ipsum dolor sit aaodijawoidjawdijaowdijaowidjmet blah blah blah blah")
-const keySize = 32
-var config = map[string]interface{}{"key": pad}
+
+// registryPath is kept outside indexDir so that backing up the indexes does
+// not also back up the keys that unlock them
+const registryPath = "tenant-keys"
+
+var registry *keys.Registry
+var config map[string]interface{}
+
+// indexConfig opens each provider's index with its own key from the
+// registry. Registry keys are already distinct per tenant, so no tenant key
+// is derived from them.
+func indexConfig(providerID string) map[string]interface{} {
+	rv := map[string]interface{}{"key_provider": registry.Provider(providerID)}
+	for k, v := range config {
+		rv[k] = v
+	}
+	return rv
+}
 
 func createOrGetIndex(id string) (bleve.Index, error) {
 	p := path.Join(indexDir, id)
-	index, err := bleve.OpenUsing(p, config)
+	index, err := bleve.OpenUsing(p, indexConfig(id))
 	if err == nil {
 		return index, nil
 	}
 	mapping := bleve.NewIndexMapping()
 
-	index, err = bleve.NewUsing(p, mapping, "upside_down", "ekv", config)
+	index, err = bleve.NewUsing(p, mapping, "upside_down", "ekv", indexConfig(id))
 	if err != nil {
 		return nil, err
 	}
 	return index, nil
 }
 
+// verifyIndex checks a provider's index, printing what it finds, and reports
+// whether the index is intact
+func verifyIndex(providerID string) bool {
+	cfg := indexConfig(providerID)
+	cfg["path"] = path.Join(indexDir, providerID, "store")
+	if _, err := os.Stat(cfg["path"].(string)); err != nil {
+		fmt.Printf("%s\t%v\n", providerID, err)
+		return false
+	}
+	report, err := ekv.Verify(cfg)
+	if report != nil {
+		for _, fault := range report.Faults {
+			fmt.Printf("%s\t%s\n", providerID, fault)
+		}
+		if report.RolledBack {
+			fmt.Printf("%s\tpages do not match the Merkle root: rolled back or modified\n", providerID)
+		}
+	}
+	if err != nil {
+		fmt.Printf("%s\t%v\n", providerID, err)
+		return false
+	}
+	if report.OK() {
+		fmt.Printf("%s\tok, %d pages verified\n", providerID, report.Pages)
+	}
+	return report.OK()
+}
+
 var providerIDs = []string{"1", "2"}
 
 func main() {
 	args, _ := docopt.Parse(usage, nil, true, "V0", false)
+	if !args["clean"].(bool) {
+		var err error
+		registry, err = keys.OpenRegistry(registryPath, keys.FromEnv())
+		if err != nil {
+			log.Fatal(err)
+		}
+		config = map[string]interface{}{"write_buffer": 4 << 20}
+		if cipher := os.Getenv("FRESNEL_CIPHER"); cipher != "" {
+			config["cipher"] = cipher
+		}
+		if compression := os.Getenv("FRESNEL_COMPRESSION"); compression != "" {
+			config["compression"] = compression
+		}
+	}
 	if args["index"].(bool) {
 		filename := args["<json_file>"].(string)
 		bytes, err := ioutil.ReadFile(filename)
@@ -56,6 +129,9 @@ func main() {
 
 		indexMap := make(map[string]bleve.Index)
 		for _, providerID := range providerIDs {
+			if registry.Revoked(providerID) {
+				continue
+			}
 			index, err := createOrGetIndex(providerID)
 			if err != nil {
 				log.Fatal(err)
@@ -67,7 +143,10 @@ func main() {
 			doc := obj.(map[string]interface{})
 			providerID := doc["provider_id"].(string)
 			docID := doc["id"].(string)
-			index := indexMap[providerID]
+			index, ok := indexMap[providerID]
+			if !ok {
+				continue
+			}
 			index.Index(docID, doc)
 		}
 		for _, ix := range indexMap {
@@ -80,8 +159,14 @@ func main() {
 
 		mergedIndex := bleve.NewIndexAlias()
 		for _, providerID := range providerIDs {
+			if registry.Revoked(providerID) {
+				continue
+			}
+			// searching never writes, so the index is opened read-only
+			cfg := indexConfig(providerID)
+			cfg["read_only"] = true
 			p := path.Join(indexDir, providerID)
-			index, err := bleve.OpenUsing(p, config)
+			index, err := bleve.OpenUsing(p, cfg)
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -95,6 +180,20 @@ func main() {
 		}
 		fmt.Println(hits)
 	}
+	if args["verify"].(bool) {
+		intact := true
+		for _, providerID := range providerIDs {
+			if registry.Revoked(providerID) {
+				continue
+			}
+			if !verifyIndex(providerID) {
+				intact = false
+			}
+		}
+		if !intact {
+			os.Exit(1)
+		}
+	}
 	if args["clean"].(bool) {
 		for _, providerID := range providerIDs {
 			p := path.Join(indexDir, providerID)
@@ -105,4 +204,25 @@ func main() {
 		}
 
 	}
+	if args["list"].(bool) {
+		for _, t := range registry.Tenants() {
+			status := "active"
+			if !t.Revoked.IsZero() {
+				status = "revoked " + t.Revoked.Format(time.RFC3339)
+			}
+			fmt.Printf("%s\tcreated %s\t%s\n", t.ID, t.Created.Format(time.RFC3339), status)
+		}
+	}
+	if args["revoke"].(bool) {
+		providerID := args["<provider_id>"].(string)
+		err := registry.Revoke(providerID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = os.RemoveAll(path.Join(indexDir, providerID))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("revoked %s\n", providerID)
+	}
 }
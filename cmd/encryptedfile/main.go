@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
   "bytes"
 
 	"github.com/awans/fresnel/encryptedfile"
+	"github.com/awans/fresnel/keys"
 	"github.com/docopt/docopt-go"
 )
 
@@ -15,12 +17,13 @@ const usage = `encryptedfile
 
 Usage:
   encryptedfile write <filename>
-  encryptedfile read <filename>`
+  encryptedfile read <filename>
+  encryptedfile verify <filename>
 
-var key = [32]byte{'0', '1', '2', '3', '4', '5', '6', '7', '8', '9',
-	'0', '1', '2', '3', '4', '5', '6', '7', '8', '9',
-	'0', '1', '2', '3', '4', '5', '6', '7', '8', '9',
-	'0', '1'}
+Verify decrypts every page, reporting any that are corrupt, truncated, under
+the wrong key or rolled back, and exits nonzero if it finds any. The key comes
+from FRESNEL_KEY_FILE, FRESNEL_KEY_SHARES (a file of key shares, one per line),
+FRESNEL_KEY (hex) or FRESNEL_PASSPHRASE, or else is prompted for.`
 
 func main() {
 	args, _ := docopt.Parse(usage, nil, true, "V0", false)
@@ -30,13 +33,15 @@ func main() {
 		toWrite := make([]byte, size)
 		toRead := make([]byte, size)
 		_, err := io.ReadFull(rand.Reader, toWrite[:])
+		if err != nil {
+			log.Fatal(err)
+		}
 
-		f, err := encryptedfile.Open(filename, key)
-		defer f.Close()
-
+		f, err := encryptedfile.OpenProvider(filename, keys.FromEnv())
 		if err != nil {
 			log.Fatal(err)
 		}
+		defer f.Close()
 		_, err = f.WriteAt(toWrite, 0)
 		if err != nil {
 			log.Fatal(err)
@@ -51,7 +56,7 @@ func main() {
 	}
 	if args["read"].(bool) {
 		filename := args["<filename>"].(string)
-		f, err := encryptedfile.Open(filename, key)
+		f, err := encryptedfile.OpenProvider(filename, keys.FromEnv(), encryptedfile.ReadOnly())
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -62,4 +67,26 @@ func main() {
 		}
 		fmt.Printf("%s", bytes)
 	}
+	if args["verify"].(bool) {
+		filename := args["<filename>"].(string)
+		f, err := encryptedfile.OpenProvider(filename, keys.FromEnv(), encryptedfile.VerifyOnly())
+		if err != nil {
+			log.Fatal(err)
+		}
+		report, err := f.Verify()
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, fault := range report.Faults {
+			fmt.Println(fault)
+		}
+		if report.RolledBack {
+			fmt.Println("pages do not match the Merkle root: rolled back or modified")
+		}
+		if !report.OK() {
+			os.Exit(1)
+		}
+		fmt.Printf("ok, %d pages verified\n", report.Pages)
+	}
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/awans/fresnel/keys"
+	"github.com/docopt/docopt-go"
+)
+
+const usage = `fresnel
+
+Usage:
+  fresnel key split <shares> <threshold>
+  fresnel key combine
+
+split reads a key from the file named by FRESNEL_KEY_FILE or the hex digits
+in FRESNEL_KEY and prints <shares> shares, one per line, any <threshold> of
+which recover it. Give each share to a different holder.
+
+combine reads shares from standard input, one per line, and prints the key
+they recover. Stores can also be opened from a file of shares directly by
+naming it in FRESNEL_KEY_SHARES.`
+
+func main() {
+	args, _ := docopt.Parse(usage, nil, true, "V0", false)
+	if args["split"].(bool) {
+		n, err := strconv.Atoi(args["<shares>"].(string))
+		if err != nil {
+			log.Fatal(err)
+		}
+		k, err := strconv.Atoi(args["<threshold>"].(string))
+		if err != nil {
+			log.Fatal(err)
+		}
+		var provider keys.KeyProvider
+		if path := os.Getenv("FRESNEL_KEY_FILE"); path != "" {
+			provider = keys.KeyFile(path)
+		} else {
+			provider = keys.EnvKey("FRESNEL_KEY")
+		}
+		key, err := provider.Key(keys.KDFParams{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		shares, err := keys.Split(key[:], n, k)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, share := range shares {
+			fmt.Println(keys.EncodeShare(share))
+		}
+	}
+	if args["combine"].(bool) {
+		shares, err := keys.ReadShares(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		key, err := keys.Combine(shares)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%x\n", key)
+	}
+}
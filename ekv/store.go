@@ -4,6 +4,8 @@ import (
 	"fmt"
 
 	"github.com/awans/fresnel/encryptedfile"
+	"github.com/awans/fresnel/keys"
+	"github.com/awans/fresnel/suite"
 	"github.com/blevesearch/bleve/index/store"
 	"github.com/blevesearch/bleve/registry"
 	"github.com/steveyen/gkvlite"
@@ -13,35 +15,60 @@ import (
 const Name = "ekv"
 const collectionName = "bleve"
 
+// ErrWrongKey is returned by New when the key does not match the one the
+// store was written with
+var ErrWrongKey = encryptedfile.ErrWrongKey
+
+// ErrNoPassphrase is returned by New when a passphrase is given for a store
+// that was created with a raw key and never given one
+var ErrNoPassphrase = encryptedfile.ErrNoPassphrase
+
+// ErrLegacyFormat is returned by New with config["read_only"] for a store
+// written before files had a header. Opening it for writing migrates it.
+var ErrLegacyFormat = encryptedfile.ErrLegacyFormat
+
+// ErrReadOnly is returned by Writer and by key changes for a store opened
+// with config["read_only"]
+var ErrReadOnly = encryptedfile.ErrReadOnly
+
 // Store is the exported interface
 type Store struct {
 	mo store.MergeOperator
 	c  *gkvlite.Collection
 	s  *gkvlite.Store
 	ef *encryptedfile.EncryptedFile
+
+	readOnly bool
 }
 
-// New returns a new encryptedkv KV
+// New returns a new encryptedkv KV. The store is opened with the key
+// provider described by keys.FromConfig. A passphrase is stretched with the
+// keys.KDFParams in config["kdf"] when the store is created. If
+// config["tenant"] is set, the store is opened with that tenant's key derived
+// from the provided master key; keys from a keys.Registry are already per
+// tenant and are used without it. A new store seals pages with the cipher suite
+// named by config["cipher"], as accepted by suite.Parse, and compresses them
+// with config["compression"], as accepted by encryptedfile.ParseCompression.
+// As with bleve's own stores, config["read_only"] opens an existing store
+// that cannot be written, and config["create_if_missing"] and
+// config["error_if_exists"] control whether a store is created. A store
+// written before files had a header is rewritten in the current format,
+// unless it is opened read-only.
 func New(mo store.MergeOperator, config map[string]interface{}) (store.KVStore, error) {
-	in, ok := config["key"].([]byte)
-	if !ok {
-		return nil, fmt.Errorf("must provide [32]byte key")
-	}
-
-	key := new([32]byte)
-	copy(key[:], in[:32])
-
-	path, ok := config["path"].(string)
-	if !ok {
-		return nil, fmt.Errorf("must specify path")
+	f, err := openFile(config)
+	if err == encryptedfile.ErrLegacyFormat && !readOnly(config) {
+		err = migrateLegacy(config)
+		if err == nil {
+			f, err = openFile(config)
+		}
 	}
-	f, err := encryptedfile.Open(path, *key)
 	if err != nil {
 		return nil, err
 	}
 
 	s, err := gkvlite.NewStore(f)
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
 	c := s.SetCollection(collectionName, nil)
@@ -52,16 +79,208 @@ func New(mo store.MergeOperator, config map[string]interface{}) (store.KVStore,
 		s:  s,
 		ef: f,
 	}
+	rv.readOnly = readOnly(config)
 
 	return &rv, nil
 }
 
-// Close closes this store
+// openFile opens the encrypted file at config["path"] as New describes, with
+// any further options
+func openFile(config map[string]interface{}, extra ...encryptedfile.Option) (*encryptedfile.EncryptedFile, error) {
+	path, provider, opts, err := fileOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, openFlags(config)...)
+	opts = append(opts, extra...)
+	return encryptedfile.OpenProvider(path, provider, opts...)
+}
+
+// migrateLegacy rewrites the legacy file at config["path"] in the current
+// format. Legacy files were sealed with the raw key, so it is asked for with
+// no key derivation parameters.
+func migrateLegacy(config map[string]interface{}) error {
+	path, provider, opts, err := fileOptions(config)
+	if err != nil {
+		return err
+	}
+	key, err := provider.Key(keys.KDFParams{})
+	if err != nil {
+		return err
+	}
+	return encryptedfile.MigrateLegacy(path, key, opts...)
+}
+
+// fileOptions returns the path, key provider and file options in config,
+// other than the open flags
+func fileOptions(config map[string]interface{}) (string, keys.KeyProvider, []encryptedfile.Option, error) {
+	provider, err := keys.FromConfig(config)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if tenant, ok := config["tenant"].(string); ok {
+		provider = keys.Tenant(provider, tenant, Name)
+	}
+
+	path, ok := config["path"].(string)
+	if !ok {
+		return "", nil, nil, fmt.Errorf("must specify path")
+	}
+	var opts []encryptedfile.Option
+	if pageSize, ok := config["page_size"].(int); ok {
+		opts = append(opts, encryptedfile.PageSize(pageSize))
+	}
+	if cacheSize, ok := config["cache_size"].(int); ok {
+		opts = append(opts, encryptedfile.CacheSize(int64(cacheSize)))
+	}
+	if writeBuffer, ok := config["write_buffer"].(int); ok {
+		opts = append(opts, encryptedfile.WriteBack(int64(writeBuffer)))
+	}
+	if params, ok := config["kdf"].(keys.KDFParams); ok {
+		opts = append(opts, encryptedfile.KDF(params))
+	}
+	if name, ok := config["cipher"].(string); ok {
+		cs, err := suite.Parse(name)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		opts = append(opts, encryptedfile.Cipher(cs))
+	}
+	if name, ok := config["compression"].(string); ok {
+		c, err := encryptedfile.ParseCompression(name)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		opts = append(opts, encryptedfile.Compress(c))
+	}
+	if rollbackProtection, ok := config["rollback_protection"].(bool); ok && rollbackProtection {
+		opts = append(opts, encryptedfile.RollbackProtection())
+	}
+	return path, provider, opts, nil
+}
+
+// openFlags returns the options for config["read_only"],
+// config["create_if_missing"] and config["error_if_exists"]
+func openFlags(config map[string]interface{}) []encryptedfile.Option {
+	if readOnly(config) {
+		return []encryptedfile.Option{encryptedfile.ReadOnly()}
+	}
+	if errorIfExists, ok := config["error_if_exists"].(bool); ok && errorIfExists {
+		return []encryptedfile.Option{encryptedfile.Exclusive()}
+	}
+	if createIfMissing, ok := config["create_if_missing"].(bool); ok && !createIfMissing {
+		return []encryptedfile.Option{encryptedfile.MustExist()}
+	}
+	return nil
+}
+
+func readOnly(config map[string]interface{}) bool {
+	readOnly, _ := config["read_only"].(bool)
+	return readOnly
+}
+
+// AddKey lets kek open the store as well as the keys that already can
+func (s *Store) AddKey(kek [32]byte) error {
+	return s.ef.AddKey(kek)
+}
+
+// RemoveKey stops kek from opening the store
+func (s *Store) RemoveKey(kek [32]byte) error {
+	return s.ef.RemoveKey(kek)
+}
+
+// RefreshKey asks the store's key provider for its key again, switching to
+// it if it has changed
+func (s *Store) RefreshKey() error {
+	return s.ef.RefreshKey()
+}
+
+// RotateDataKey starts sealing new pages of the store with a fresh data key
+func (s *Store) RotateDataKey() error {
+	return s.ef.RotateDataKey()
+}
+
+// RetireDataKeys rewrites pages sealed with older data keys and forgets them
+func (s *Store) RetireDataKeys() error {
+	return s.ef.RetireDataKeys()
+}
+
+// AddPassphrase lets passphrase open the store as well as the keys that
+// already can
+func (s *Store) AddPassphrase(passphrase []byte) error {
+	return s.ef.AddPassphrase(passphrase)
+}
+
+// RemovePassphrase stops passphrase from opening the store
+func (s *Store) RemovePassphrase(passphrase []byte) error {
+	return s.ef.RemovePassphrase(passphrase)
+}
+
+// Verify checks every page of the store's encrypted file, then, if they are
+// all intact, walks the index to check that its structure reads back. Only
+// what has been written to the file is checked.
+func (s *Store) Verify() (*encryptedfile.Report, error) {
+	report, err := s.ef.Verify()
+	if err != nil || !report.OK() {
+		return report, err
+	}
+	return report, verifyIndex(s.s.Snapshot())
+}
+
+// Verify checks the store described by config as Store.Verify does, without
+// loading its index first, so a store too damaged to open can be checked.
+// The store is opened with encryptedfile.VerifyOnly, so a store whose pages do
+// not match its Merkle root still gets a report of which pages fail.
+func Verify(config map[string]interface{}) (*encryptedfile.Report, error) {
+	ro := map[string]interface{}{}
+	for k, v := range config {
+		ro[k] = v
+	}
+	ro["read_only"] = true
+	f, err := openFile(ro, encryptedfile.VerifyOnly())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	report, err := f.Verify()
+	if err != nil || !report.OK() {
+		return report, err
+	}
+	s, err := gkvlite.NewStore(f)
+	if err != nil {
+		return report, fmt.Errorf("index structure: %v", err)
+	}
+	defer s.Close()
+	return report, verifyIndex(s)
+}
+
+// verifyIndex reads every item of the index
+func verifyIndex(s *gkvlite.Store) error {
+	c := s.GetCollection(collectionName)
+	if c == nil {
+		return nil
+	}
+	err := c.VisitItemsAscend(nil, true, func(*gkvlite.Item) bool {
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("index structure: %v", err)
+	}
+	return nil
+}
+
+// Close closes this store and its encrypted file, which wipes the file's keys
+// and decrypted pages from memory
 func (s *Store) Close() error {
-	s.s.Flush()
+	var err error
+	if !s.readOnly {
+		err = s.s.Flush()
+	}
 	s.s.Close()
-	s.ef.Sync()
-	return nil
+	if cerr := s.ef.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 // Reader returns a KV reader
@@ -72,8 +291,11 @@ func (s *Store) Reader() (store.KVReader, error) {
 	return &rv, nil
 }
 
-// Writer returns a KV writer
+// Writer returns a KV writer, or ErrReadOnly if the store was opened read-only
 func (s *Store) Writer() (store.KVWriter, error) {
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
 	return &Writer{s: s}, nil
 }
 
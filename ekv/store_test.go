@@ -13,11 +13,16 @@
 package ekv
 
 import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
 	"os"
 	"testing"
 
+	"github.com/awans/fresnel/encryptedfile"
+	"github.com/awans/fresnel/storetest"
 	"github.com/blevesearch/bleve/index/store"
-	"github.com/blevesearch/bleve/index/store/test"
+	"golang.org/x/crypto/nacl/secretbox"
 )
 
 func open(t *testing.T, mo store.MergeOperator) store.KVStore {
@@ -41,56 +46,107 @@ func cleanup(t *testing.T, s store.KVStore) {
 	}
 }
 
-func TestEncryptedKVKVCrud(t *testing.T) {
-	s := open(t, nil)
-	defer cleanup(t, s)
-	test.CommonTestKVCrud(t, s)
-}
-
-func TestEncryptedKVReaderIsolation(t *testing.T) {
-	s := open(t, nil)
-	defer cleanup(t, s)
-	test.CommonTestReaderIsolation(t, s)
+var backend = storetest.Backend{
+	New: New,
+	Verify: func(config map[string]interface{}) (bool, error) {
+		report, err := Verify(config)
+		if err != nil {
+			return false, err
+		}
+		return report.OK(), nil
+	},
+	ErrWrongKey:     ErrWrongKey,
+	ErrNoPassphrase: ErrNoPassphrase,
+	ErrReadOnly:     ErrReadOnly,
 }
 
-func TestEncryptedKVReaderOwnsGetBytes(t *testing.T) {
-	s := open(t, nil)
-	defer cleanup(t, s)
-	test.CommonTestReaderOwnsGetBytes(t, s)
+func TestEncryptedKVStore(t *testing.T) {
+	storetest.Run(t, backend)
 }
 
-func TestEncryptedKVWriterOwnsBytes(t *testing.T) {
+func TestEncryptedKVVerifyOpenStore(t *testing.T) {
 	s := open(t, nil)
 	defer cleanup(t, s)
-	test.CommonTestWriterOwnsBytes(t, s)
+	storetest.Set(t, s, "k", "v")
+	report, err := s.(*Store).Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("expected an intact store, got faults %v", report.Faults)
+	}
 }
 
-func TestEncryptedKVPrefixIterator(t *testing.T) {
-	s := open(t, nil)
-	defer cleanup(t, s)
-	test.CommonTestPrefixIterator(t, s)
-}
+func TestEncryptedKVReadOnlyLeavesFileUntouched(t *testing.T) {
+	config := map[string]interface{}{"key": []byte("testtesttesttesttesttesttesttesttest"),
+		"path": "test", "read_only": true}
+	_, err := New(nil, config)
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected a missing store to be an error, got %v", err)
+	}
 
-func TestEncryptedKVPrefixIteratorSeek(t *testing.T) {
 	s := open(t, nil)
-	defer cleanup(t, s)
-	test.CommonTestPrefixIteratorSeek(t, s)
-}
+	defer os.RemoveAll("test")
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile("test")
+	if err != nil {
+		t.Fatal(err)
+	}
 
-func TestEncryptedKVRangeIterator(t *testing.T) {
-	s := open(t, nil)
-	defer cleanup(t, s)
-	test.CommonTestRangeIterator(t, s)
+	s, err = New(nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := ioutil.ReadFile("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatal("expected a read-only store to leave its file untouched")
+	}
 }
 
-func TestEncryptedKVRangeIteratorSeek(t *testing.T) {
-	s := open(t, nil)
-	defer cleanup(t, s)
-	test.CommonTestRangeIteratorSeek(t, s)
-}
+func TestEncryptedKVMigratesLegacyFile(t *testing.T) {
+	key := []byte("testtesttesttesttesttesttesttesttest")
+	var k [32]byte
+	copy(k[:], key)
+	defer os.RemoveAll("test")
+	// a legacy file is bare secretbox pages under the raw key
+	var nonce [24]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pg := make([]byte, 4096-24-secretbox.Overhead)
+	err = ioutil.WriteFile("test", secretbox.Seal(nonce[:], pg, &nonce, &k), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-func TestEncryptedKVMerge(t *testing.T) {
-	s := open(t, &test.TestMergeCounter{})
-	defer cleanup(t, s)
-	test.CommonTestMerge(t, s)
+	config := map[string]interface{}{"key": key, "path": "test", "read_only": true}
+	_, err = New(nil, config)
+	if err != ErrLegacyFormat {
+		t.Fatalf("expected ErrLegacyFormat, got %v", err)
+	}
+	delete(config, "read_only")
+	s, err := New(nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := encryptedfile.Open("test", k, encryptedfile.ReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
 }
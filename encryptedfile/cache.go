@@ -0,0 +1,129 @@
+package encryptedfile
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/awans/fresnel/keys"
+)
+
+// DefaultCacheSize is the default memory budget for decrypted pages
+const DefaultCacheSize = 4 << 20
+
+// CacheStats reports the effectiveness of the decrypted page cache
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	Pages  int
+	Bytes  int64
+}
+
+type cacheEntry struct {
+	pgID int64
+	data []byte
+}
+
+// pageCache is an LRU cache of decrypted pages bounded by a byte budget.
+// It has its own lock because concurrent ReadAts only hold the file's read
+// lock.
+type pageCache struct {
+	m      sync.Mutex
+	budget int64
+	size   int64
+	ll     *list.List
+	items  map[int64]*list.Element
+	hits   uint64
+	misses uint64
+}
+
+func newPageCache(budget int64) *pageCache {
+	return &pageCache{
+		budget: budget,
+		ll:     list.New(),
+		items:  make(map[int64]*list.Element),
+	}
+}
+
+// get returns a copy of the cached page, so callers may modify it
+func (c *pageCache) get(pgID int64) ([]byte, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	el, ok := c.items[pgID]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.ll.MoveToFront(el)
+	data := el.Value.(*cacheEntry).data
+	rv := make([]byte, len(data))
+	copy(rv, data)
+	return rv, true
+}
+
+func (c *pageCache) contains(pgID int64) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	_, ok := c.items[pgID]
+	return ok
+}
+
+// put stores a copy of data as the current contents of pgID
+func (c *pageCache) put(pgID int64, data []byte) {
+	if int64(len(data)) > c.budget {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if el, ok := c.items[pgID]; ok {
+		copy(el.Value.(*cacheEntry).data, data)
+		c.ll.MoveToFront(el)
+		return
+	}
+	entry := &cacheEntry{pgID: pgID, data: make([]byte, len(data))}
+	copy(entry.data, data)
+	c.items[pgID] = c.ll.PushFront(entry)
+	c.size += int64(len(data))
+	for c.size > c.budget {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// truncate drops every page at or after pgID
+func (c *pageCache) truncate(pgID int64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for id, el := range c.items {
+		if id >= pgID {
+			c.removeElement(el)
+		}
+	}
+}
+
+// removeElement evicts a page, scrubbing its plaintext
+func (c *pageCache) removeElement(el *list.Element) {
+	entry := c.ll.Remove(el).(*cacheEntry)
+	delete(c.items, entry.pgID)
+	c.size -= int64(len(entry.data))
+	keys.Wipe(entry.data)
+}
+
+// clear evicts every page
+func (c *pageCache) clear() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for c.ll.Len() > 0 {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *pageCache) stats() CacheStats {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return CacheStats{
+		Hits:   c.hits,
+		Misses: c.misses,
+		Pages:  c.ll.Len(),
+		Bytes:  c.size,
+	}
+}
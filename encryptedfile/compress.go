@@ -0,0 +1,133 @@
+package encryptedfile
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/awans/fresnel/keys"
+	"github.com/golang/snappy"
+)
+
+// Compression is an algorithm pages are compressed with before sealing
+type Compression uint8
+
+// Compression algorithms
+const (
+	NoCompression Compression = iota
+	Snappy
+	Flate
+)
+
+var compressionNames = map[Compression]string{
+	NoCompression: "none",
+	Snappy:        "snappy",
+	Flate:         "flate",
+}
+
+func (c Compression) String() string {
+	if name, ok := compressionNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("compression %d", uint8(c))
+}
+
+// ParseCompression returns the compression algorithm named name
+func ParseCompression(name string) (Compression, error) {
+	for c, n := range compressionNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return NoCompression, fmt.Errorf("unknown compression %q", name)
+}
+
+func validCompression(c Compression) bool {
+	_, ok := compressionNames[c]
+	return ok
+}
+
+// A page of a compressed file is sealed as a frame: a kind byte, the length
+// of the data that follows, and the data, either compressed or raw when
+// compression would not make it smaller.
+const frameHeaderSize = 5
+
+const (
+	frameRaw byte = iota
+	frameCompressed
+)
+
+// frame compresses a page into a new frame, padded with zeros so that once
+// sealed with overhead more bytes it fills a whole number of units
+func (f *EncryptedFile) frame(data []byte, overhead int64) ([]byte, error) {
+	var compressed []byte
+	switch Compression(f.hdr.Compression) {
+	case Snappy:
+		compressed = snappy.Encode(nil, data)
+	case Flate:
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		w.Write(data)
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+		compressed = buf.Bytes()
+	}
+	kind, body := frameCompressed, compressed
+	if len(compressed) >= len(data) {
+		kind, body = frameRaw, data
+	}
+	size := f.pmap.unitsFor(overhead+frameHeaderSize+int64(len(body)))*f.pmap.unitSize - overhead
+	out := make([]byte, size)
+	out[0] = kind
+	binary.BigEndian.PutUint32(out[1:], uint32(len(body)))
+	copy(out[frameHeaderSize:], body)
+	keys.Wipe(compressed)
+	return out, nil
+}
+
+// unframe returns the page held by a frame, which must decompress to exactly
+// one page
+func (f *EncryptedFile) unframe(pgID int64, frame []byte) ([]byte, error) {
+	if len(frame) < frameHeaderSize {
+		return nil, ErrCorruptPage{PageID: pgID}
+	}
+	n := int64(binary.BigEndian.Uint32(frame[1:]))
+	if n > int64(len(frame)-frameHeaderSize) {
+		return nil, ErrCorruptPage{PageID: pgID}
+	}
+	body := frame[frameHeaderSize : frameHeaderSize+n]
+	data := make([]byte, f.dataPgSize)
+	switch {
+	case frame[0] == frameRaw && n == f.dataPgSize:
+		copy(data, body)
+		return data, nil
+	case frame[0] != frameCompressed:
+		return nil, ErrCorruptPage{PageID: pgID}
+	case Compression(f.hdr.Compression) == Snappy:
+		l, err := snappy.DecodedLen(body)
+		if err == nil && int64(l) == f.dataPgSize {
+			_, err = snappy.Decode(data, body)
+			if err == nil {
+				return data, nil
+			}
+		}
+	case Compression(f.hdr.Compression) == Flate:
+		r := flate.NewReader(bytes.NewReader(body))
+		_, err := io.ReadFull(r, data)
+		if err == nil {
+			var extra [1]byte
+			if m, _ := r.Read(extra[:]); m == 0 {
+				return data, nil
+			}
+		}
+	}
+	keys.Wipe(data)
+	return nil, ErrCorruptPage{PageID: pgID}
+}
@@ -2,121 +2,678 @@ package encryptedfile
 
 import (
 	"crypto/rand"
-	"fmt"
+	"encoding/binary"
 	"io"
 	"os"
 	"sync"
 	"time"
 
-	"golang.org/x/crypto/nacl/secretbox"
+	"github.com/awans/fresnel/keys"
+	"github.com/awans/fresnel/suite"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
-const pgSize = 4096
-const nonceSize = 24
-const dataPgSize = pgSize - secretbox.Overhead - nonceSize
+// nonceSize is the nonce size for wrapped keys and ring entries, which are
+// always sealed with XChaCha20-Poly1305
+const nonceSize = chacha20poly1305.NonceSizeX
+const fileIDSize = 16
 
 type page struct {
 	Data []byte
 	pgID int64
 }
 
-// EncryptedFile wraps access to an os.File in transparent secretbox encryption
-// Satisfies the gkvlite StoreFile interface
+// EncryptedFile wraps access to an os.File in transparent authenticated
+// encryption, with the cipher suite recorded in its header. Each page is authenticated together with its page number and
+// the file ID, so pages cannot be swapped, replayed or moved between files.
+// The header stores a random file key wrapped under one or more
+// key-encryption keys, and a ring of data keys sealed under the file key.
+// Each page names the data key it is sealed with. A compressed file
+// compresses pages before sealing them and packs them through a page map;
+// any other file journals its writes, so that after a crash each WriteAt and
+// Sync has either happened entirely or not at all.
+// Satisfies the gkvlite StoreFile interface, and io.ReadWriteSeeker for use
+// as a general encrypted file
 type EncryptedFile struct {
-	key  [32]byte
-	file *os.File
-	m    sync.RWMutex
+	mem         *keys.Memory
+	key         *[32]byte // file key
+	kek         *[32]byte // key-encryption key the file was opened with
+	nextKey     *[32]byte // file key being rotated to
+	provider    keys.KeyProvider
+	ringKeys    map[uint32]*[32]byte
+	keyID       uint32 // newest data key, which pages are sealed with
+	suite       suite.Suite
+	closed      bool
+	readOnly    bool
+	badRoot     bool // opened with VerifyOnly despite not matching its root
+	hdr         *header
+	tree        *merkleTree
+	pgSize      int64
+	dataPgSize  int64
+	pgNonceSize int
+	commitSize  int // size of each page's key commitment, if it has one
+	cache       *pageCache
+	workers     int
+	writeBack   int64
+	dirty       map[int64][]byte
+	dirtySize   int64
+	numPg       int64    // pages sealed on disk or in the write-back buffer
+	pmap        *pageMap // where each page is stored, for a compressed file
+	journal     *journal // makes in-place writes atomic, for an uncompressed file
+	offset      int64    // where Read and Write continue from
+	append      bool     // Write always appends
+	offsetM     sync.Mutex
+	syncedSize  int64
+	file        *os.File
+	m           sync.RWMutex
 }
 
-// Open returns an encrypted file
-func Open(name string, key [32]byte) (*EncryptedFile, error) {
-	file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, os.FileMode(0644))
+// Open returns an encrypted file. key is a key-encryption key: a new file
+// gets a random data key wrapped under it, and an existing file is opened if
+// key unwraps its data key. Unless the options say otherwise, a missing file
+// is created with mode 0600.
+func Open(name string, key [32]byte, opts ...Option) (*EncryptedFile, error) {
+	o, err := newOptions(opts)
 	if err != nil {
 		return nil, err
 	}
-	return &EncryptedFile{key: key, file: file}, nil
+	file, err := os.OpenFile(name, o.flag(), o.mode)
+	if err != nil {
+		return nil, err
+	}
+	mem, err := keys.NewMemory(memKeys)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f := &EncryptedFile{
+		file:      file,
+		cache:     newPageCache(o.cacheSize),
+		workers:   o.workers,
+		writeBack: o.writeBack,
+		append:    o.append,
+		readOnly:  o.readOnly,
+		dirty:     make(map[int64][]byte),
+		mem:       mem,
+		key:       mem.Key(0),
+		kek:       mem.Key(1),
+		nextKey:   mem.Key(2),
+	}
+	*f.kek = key
+	err = f.readOrInitHeader(key, o)
+	if err != nil {
+		f.wipe()
+		f.closeJournal()
+		file.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// memKeys is how many keys a file holds in locked memory: the file key, the
+// key-encryption key, the next file key and the data keys of the ring
+const memKeys = 3 + maxRingKeys
+
+// wipe clears every key and decrypted page the file holds. The keys are left
+// pointing at zeroed heap memory, since the locked memory is released.
+func (f *EncryptedFile) wipe() {
+	f.cache.clear()
+	for pgID, data := range f.dirty {
+		keys.Wipe(data)
+		delete(f.dirty, pgID)
+	}
+	f.dirtySize = 0
+	f.ringKeys = nil
+	f.mem.Free()
+	f.key, f.kek, f.nextKey = new([32]byte), new([32]byte), new([32]byte)
+}
+
+// readOrInitHeader loads and verifies the file header, writing a fresh
+// header if the file is empty
+func (f *EncryptedFile) readOrInitHeader(kek [32]byte, o *options) error {
+	fi, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 && f.readOnly {
+		return errEmptyReadOnly
+	}
+	if fi.Size() == 0 {
+		f.suite = o.suite
+		f.hdr, err = newHeader(o)
+		if err == nil {
+			*f.key, err = newDataKey()
+		}
+		if err == nil {
+			f.hdr.Wrapped[0], err = wrapKey(kek, *f.key, f.hdr.FileID)
+		}
+		if err == nil {
+			f.ringKeys = make(map[uint32]*[32]byte)
+			err = f.newRingKey()
+		}
+		if err == nil {
+			err = f.writeHeader()
+		}
+	} else {
+		f.hdr, *f.key, err = f.readHeader(kek)
+		if err == errNoHeader && isLegacy(f.file, fi.Size(), kek) {
+			err = ErrLegacyFormat
+		}
+		if err == nil {
+			f.suite, err = suite.ByID(f.hdr.Cipher)
+		}
+		if err == nil {
+			err = f.loadRing()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	f.pgSize = int64(f.hdr.PageSize)
+	aead, err := f.dataCipher(f.ringKeys[f.keyID])
+	if err != nil {
+		return err
+	}
+	f.pgNonceSize = aead.NonceSize()
+	if f.hdr.Flags&flagCommitted != 0 {
+		f.commitSize = suite.CommitmentSize
+	}
+	f.dataPgSize = f.pgSize - int64(keyIDSize+f.pgNonceSize+f.commitSize+aead.Overhead())
+	f.syncedSize = f.hdr.Size
+	if f.hdr.Compression == 0 && f.readOnly {
+		err = f.checkJournal()
+	} else if f.hdr.Compression == 0 {
+		err = f.openJournal(fi.Mode().Perm())
+	}
+	if err != nil {
+		return err
+	}
+	fi, err = f.file.Stat()
+	if err != nil {
+		return err
+	}
+	f.numPg = (fi.Size() - headerSize) / f.pgSize
+	if sized := (f.hdr.Size + f.dataPgSize - 1) / f.dataPgSize; f.hdr.Compression == 0 && sized < f.numPg {
+		// pages past the size are left by a Truncate interrupted once its
+		// header was committed
+		f.numPg = sized
+		if !f.readOnly {
+			err = f.file.Truncate(headerSize + sized*f.pgSize)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if f.hdr.Compression != 0 {
+		err = f.readMap(fi.Size())
+		if err != nil {
+			return err
+		}
+		f.dataPgSize -= frameHeaderSize
+		f.numPg = int64(len(f.pmap.pages))
+	}
+
+	if f.hdr.Flags&flagMerkle != 0 {
+		f.tree, err = f.buildMerkleTree()
+		if err != nil {
+			return err
+		}
+		if f.tree.root() != f.hdr.Root {
+			f.badRoot = true
+		}
+	}
+	if o.pinnedRoot != nil && (f.tree == nil || *o.pinnedRoot != f.hdr.Root) {
+		f.badRoot = true
+	}
+	if f.badRoot && !o.verifyOnly {
+		return ErrRollback
+	}
+
+	if f.hdr.Flags&flagRekey != 0 {
+		if o.resumeRekey == nil {
+			return ErrRekeyInProgress
+		}
+		var ok bool
+		*f.nextKey, ok = f.hdr.NextWrapped.unwrap(*o.resumeRekey, f.hdr.FileID)
+		if !ok || f.hdr.keyCheck(*f.nextKey) != f.hdr.NextKeyCheck {
+			return ErrWrongKey
+		}
+	}
+	return nil
+}
+
+// syncHeader writes a new header generation if the size, Merkle root or page
+// map has changed since the last one, and otherwise just checkpoints the
+// journal
+func (f *EncryptedFile) syncHeader() error {
+	if f.hdr.Size == f.syncedSize && (f.tree == nil || f.tree.root() == f.hdr.Root) &&
+		(f.pmap == nil || !f.pmap.dirty) {
+		return f.checkpoint()
+	}
+	return f.commitHeader()
+}
+
+// commitHeader makes every page written so far durable, then writes a new
+// header generation describing them
+func (f *EncryptedFile) commitHeader() error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+	if f.pmap != nil {
+		err := f.writeMap()
+		if err != nil {
+			return err
+		}
+	}
+	err := f.applyJournal()
+	if err != nil {
+		return err
+	}
+	err = f.file.Sync()
+	if err != nil {
+		return err
+	}
+	if f.tree != nil {
+		f.hdr.Root = f.tree.root()
+	}
+	err = f.writeHeader()
+	if err != nil {
+		return err
+	}
+	f.syncedSize = f.hdr.Size
+	// units released since the last header may only be reused, and the
+	// journal only emptied, once the new header is durable
+	err = f.file.Sync()
+	if err != nil {
+		return err
+	}
+	if f.pmap != nil {
+		f.pmap.committed()
+	}
+	if f.journal != nil {
+		return f.journal.clear()
+	}
+	return nil
+}
+
+// additionalData binds a sealed page to its page number, its data key and
+// this file
+func (f *EncryptedFile) additionalData(pgID int64, keyID uint32) []byte {
+	ad := make([]byte, fileIDSize+8+keyIDSize)
+	copy(ad, f.hdr.FileID[:])
+	binary.BigEndian.PutUint64(ad[fileIDSize:], uint64(pgID))
+	binary.BigEndian.PutUint32(ad[fileIDSize+8:], keyID)
+	return ad
 }
 
-// Close closes an encrypted file
+// Close flushes any buffered pages and closes an encrypted file, wiping its
+// keys and decrypted pages from memory
 func (f *EncryptedFile) Close() error {
 	f.m.Lock()
 	defer f.m.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	var err error
+	if !f.readOnly {
+		err = f.flush()
+		if err == nil {
+			err = f.syncHeader()
+		}
+	}
+	f.wipe()
+	if err != nil {
+		f.closeJournal()
+		f.file.Close()
+		return err
+	}
+	err = f.closeJournal()
+	if err != nil {
+		f.file.Close()
+		return err
+	}
 	return f.file.Close()
 }
 
-// Sync implements os.File
+// Sync flushes any buffered pages and implements os.File. A read-only file
+// has nothing to sync.
 func (f *EncryptedFile) Sync() error {
 	f.m.Lock()
 	defer f.m.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.readOnly {
+		return nil
+	}
+	err := f.flush()
+	if err != nil {
+		return err
+	}
+	err = f.syncHeader()
+	if err != nil {
+		return err
+	}
 	return f.file.Sync()
 }
 
+// writePages seals and writes a contiguous run of pages, wiping their
+// plaintext once written
 func (f *EncryptedFile) writePages(pages []page) error {
-	encryptedBytes := make([]byte, len(pages)*pgSize)
-	for i, pg := range pages {
-		nonce := new([nonceSize]byte)
-		_, err := io.ReadFull(rand.Reader, nonce[:])
+	return f.writeRuns([][]page{pages})
+}
+
+// sealedRun is a contiguous run of pages sealed for writing
+type sealedRun struct {
+	pages  []page
+	block  []byte   // the sealed pages back to back, if written in place
+	sealed [][]byte // each sealed page
+	hashes [][32]byte
+}
+
+// writeRuns seals and writes contiguous runs of pages, wiping their plaintext
+// once written. A compressed file writes each page framed to free units.
+// Otherwise pages of the last header go into the journal as one transaction,
+// so a crash leaves either all of them or none, and the rest of each run is
+// written in place as one contiguous block.
+func (f *EncryptedFile) writeRuns(runs [][]page) error {
+	if f.readOnly {
+		return ErrReadOnly
+	}
+	sealed := make([]*sealedRun, len(runs))
+	for i, pages := range runs {
+		run, err := f.sealRun(pages)
+		if err != nil {
+			return err
+		}
+		sealed[i] = run
+	}
+	// the tree takes the new hashes first, so the journal records the root
+	// the file has once the runs are written
+	undo := f.setHashes(sealed)
+	var ids []int64
+	var journaled [][]byte
+	if f.journal != nil {
+		committed := f.committedPages()
+		for _, run := range sealed {
+			for i, pg := range run.pages {
+				if pg.pgID < committed {
+					ids = append(ids, pg.pgID)
+					journaled = append(journaled, run.sealed[i])
+				}
+			}
+		}
+	}
+	if len(ids) > 0 {
+		err := f.journal.append(f.journalEntry(ids, journaled))
+		if err != nil {
+			undo()
+			return err
+		}
+	}
+	for _, run := range sealed {
+		var err error
+		if f.pmap != nil {
+			err = f.writeMapped(run.pages[0].pgID, run.sealed)
+		} else if skip := f.journaledPages(run); skip < len(run.pages) {
+			off := headerSize + run.pages[skip].pgID*f.pgSize
+			_, err = f.file.WriteAt(run.block[int64(skip)*f.pgSize:], off)
+		}
+		if err != nil {
+			undo()
+			return err
+		}
+	}
+	for i, pgID := range ids {
+		f.journal.pages[pgID] = journaled[i]
+	}
+	// only wipe the plaintext once every run is written, so a failed write
+	// can be retried
+	for _, run := range sealed {
+		for _, pg := range run.pages {
+			f.cache.put(pg.pgID, pg.Data)
+			keys.Wipe(pg.Data)
+		}
+		if last := run.pages[len(run.pages)-1].pgID; last >= f.numPg {
+			f.numPg = last + 1
+		}
+	}
+	return nil
+}
+
+// journaledPages is how many pages at the start of run go into the journal
+// rather than straight to the file
+func (f *EncryptedFile) journaledPages(run *sealedRun) int {
+	if f.journal == nil {
+		return 0
+	}
+	committed := f.committedPages()
+	n := 0
+	for n < len(run.pages) && run.pages[n].pgID < committed {
+		n++
+	}
+	return n
+}
+
+// setHashes sets the Merkle leaves of sealed runs, returning a function that
+// restores the old leaves if the runs are not written after all
+func (f *EncryptedFile) setHashes(runs []*sealedRun) func() {
+	if f.tree == nil {
+		return func() {}
+	}
+	leaves := f.tree.numLeaves()
+	old := make(map[int64][32]byte)
+	for _, run := range runs {
+		for i, pg := range run.pages {
+			if pg.pgID < leaves {
+				old[pg.pgID] = f.tree.leaf(pg.pgID)
+			}
+			f.tree.set(pg.pgID, run.hashes[i])
+		}
+	}
+	return func() {
+		f.tree.truncate(leaves)
+		for pgID, h := range old {
+			f.tree.set(pgID, h)
+		}
+	}
+}
+
+// sealRun seals a contiguous run of pages with the newest data key
+func (f *EncryptedFile) sealRun(pages []page) (*sealedRun, error) {
+	pgSize := int(f.pgSize)
+	run := &sealedRun{
+		pages:  pages,
+		sealed: make([][]byte, len(pages)),
+		hashes: make([][32]byte, len(pages)),
+	}
+	if f.pmap == nil {
+		run.block = make([]byte, len(pages)*pgSize)
+	}
+	keyID, key := f.keyID, f.ringKeys[f.keyID]
+	aead, err := f.dataCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := keyIDSize + f.pgNonceSize + f.commitSize
+	err = parallel(f.workers, len(pages), func(i int) error {
+		pg := pages[i]
+		data := pg.Data
+		var out []byte
+		if f.pmap != nil {
+			frame, err := f.frame(pg.Data, int64(prefix+aead.Overhead()))
+			if err != nil {
+				return err
+			}
+			defer keys.Wipe(frame)
+			data = frame
+			out = make([]byte, prefix, prefix+len(frame)+aead.Overhead())
+		} else {
+			out = run.block[i*pgSize : i*pgSize+prefix]
+		}
+		binary.BigEndian.PutUint32(out, keyID)
+		nonce := out[keyIDSize : keyIDSize+f.pgNonceSize]
+		_, err := io.ReadFull(rand.Reader, nonce)
 		if err != nil {
 			return err
 		}
-		out := make([]byte, nonceSize)
-		copy(out, nonce[:])
-		outVal := secretbox.Seal(out, pg.Data, nonce, &f.key)
-		copy(encryptedBytes[i*pgSize:(i+1)*pgSize], outVal)
+		if f.commitSize > 0 {
+			c := suite.Commit(key[:], nonce)
+			copy(out[keyIDSize+f.pgNonceSize:], c[:])
+		}
+		run.sealed[i] = aead.Seal(out, nonce, data, f.additionalData(pg.pgID, keyID))
+		if f.tree != nil {
+			run.hashes[i] = leafHash(run.sealed[i])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	_, err := f.file.WriteAt(encryptedBytes, pages[0].pgID*pgSize)
-	return err
+	return run, nil
 }
 
+// loadPages returns the decrypted pages from start to end inclusive, serving
+// what it can from the cache and reading runs of missing pages from disk
 func (f *EncryptedFile) loadPages(start int64, end int64) ([]page, error) {
 	var pages []page
-	startReadOffset := int64(pgSize * start)
-	readLen := pgSize * (end + 1 - start)
-	bytes := make([]byte, readLen)
-	n, err := f.file.ReadAt(bytes, startReadOffset)
-	if err != nil && err != io.EOF {
-		return nil, err
+	for pgID := start; pgID <= end; {
+		data, ok := f.dirtyPage(pgID)
+		if !ok {
+			data, ok = f.cache.get(pgID)
+		}
+		if ok {
+			pages = append(pages, page{Data: data, pgID: pgID})
+			pgID++
+			continue
+		}
+		runEnd := pgID
+		for runEnd < end && !f.cache.contains(runEnd+1) && f.dirty[runEnd+1] == nil {
+			runEnd++
+		}
+		run, err := f.readPages(pgID, runEnd)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, run...)
+		pgID = runEnd + 1
 	}
-	for i := int64(0); i < end-start+1; i++ {
+	return pages, nil
+}
 
+// readPages reads and decrypts the pages from start to end inclusive from disk
+func (f *EncryptedFile) readPages(start int64, end int64) ([]page, error) {
+	pages := make([]page, end-start+1)
+	sealed, err := f.readSealed(start, end)
+	if err != nil {
+		return nil, err
+	}
+	err = parallel(f.workers, len(pages), func(idx int) error {
+		i := int64(idx)
 		pgID := int64(i + start)
-		pg := page{pgID: pgID}
-		// if we're off the end of the file, just copy over the empty bytes
+		pg := &pages[i]
+		pg.pgID = pgID
+		// if we're off the end of the file, the page reads as zeros
 		// no decryption necessary
-		if (i+1)*pgSize > int64(n) {
-			pg.Data = bytes[pgSize*i : pgSize*i+dataPgSize]
-			pages = append(pages, pg)
-			continue
+		if sealed[i] == nil {
+			if f.tree != nil && pgID < f.tree.numLeaves() {
+				return ErrCorruptPage{PageID: pgID}
+			}
+			pg.Data = make([]byte, f.dataPgSize)
+			return nil
 		}
 
-		dataPg := bytes[pgSize*i : pgSize*(i+1)]
-		nonce := new([nonceSize]byte)
-		copy(nonce[:], dataPg[:nonceSize])
-		data, ok := secretbox.Open(nil, dataPg[nonceSize:], nonce, &f.key)
-		if !ok {
-			return nil, fmt.Errorf("Decryption failed")
+		dataPg := sealed[i]
+		if f.tree != nil && (pgID >= f.tree.numLeaves() || leafHash(dataPg) != f.tree.leaf(pgID)) {
+			return ErrCorruptPage{PageID: pgID}
+		}
+		data, err := f.openPage(pgID, dataPg)
+		if err != nil {
+			return err
+		}
+		if f.pmap != nil {
+			frame := data
+			data, err = f.unframe(pgID, frame)
+			keys.Wipe(frame)
+			if err != nil {
+				return err
+			}
 		}
 		pg.Data = data
-		pages = append(pages, pg)
+		f.cache.put(pgID, data)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return pages, nil
 }
 
-// ReadAt implements ReaderAt
+// readSealed reads the sealed pages from start to end inclusive, with nil for
+// pages past the end of the file
+func (f *EncryptedFile) readSealed(start int64, end int64) ([][]byte, error) {
+	if f.pmap != nil {
+		return f.readMapped(start, end)
+	}
+	pgSize := f.pgSize
+	bytes := make([]byte, pgSize*(end+1-start))
+	n, err := f.file.ReadAt(bytes, headerSize+pgSize*start)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	sealed := make([][]byte, end-start+1)
+	for i := range sealed {
+		if int64(i+1)*pgSize <= int64(n) {
+			sealed[i] = bytes[pgSize*int64(i) : pgSize*int64(i+1)]
+		}
+		// pages still in the journal are newer than the file's
+		if f.journal != nil {
+			if pg, ok := f.journal.pages[start+int64(i)]; ok {
+				sealed[i] = pg
+			}
+		}
+	}
+	return sealed, nil
+}
+
+// ReadAt implements ReaderAt. Like os.File, it returns io.EOF when p extends
+// past the end of the file.
 func (f *EncryptedFile) ReadAt(p []byte, off int64) (n int, err error) {
 	f.m.RLock()
 	defer f.m.RUnlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	if off >= f.hdr.Size {
+		return 0, io.EOF
+	}
+	if off+int64(len(p)) > f.hdr.Size {
+		n, err = f.readAt(p[:f.hdr.Size-off], off)
+		if err == nil {
+			err = io.EOF
+		}
+		return
+	}
+	return f.readAt(p, off)
+}
+
+func (f *EncryptedFile) readAt(p []byte, off int64) (n int, err error) {
 	n = 0
-	startPgNum := off / dataPgSize
-	startPgOffset := off % dataPgSize
-	end := off + int64(len(p))
-	endPgNum := end / dataPgSize
-	endPgOffset := end % dataPgSize
+	if len(p) == 0 {
+		return
+	}
+	dataPgSize := f.dataPgSize
+	startPgNum, startPgOffset, endPgNum, endPgOffset := f.pageRange(p, off)
 
 	pages, err := f.loadPages(startPgNum, endPgNum)
 	if err != nil {
 		return
 	}
+	defer wipePages(pages)
 	if len(pages) == 1 {
 		// start and end page
 		n += copy(p[:endPgOffset-startPgOffset], pages[0].Data[startPgOffset:endPgOffset])
@@ -130,7 +687,7 @@ func (f *EncryptedFile) ReadAt(p []byte, off int64) (n int, err error) {
 				n += copy(p[n:int64(n)+endPgOffset], pg.Data[:endPgOffset])
 			} else {
 				// middle page
-				n += copy(p[n:n+dataPgSize], pg.Data[:])
+				n += copy(p[n:int64(n)+dataPgSize], pg.Data[:])
 			}
 		}
 	}
@@ -138,16 +695,51 @@ func (f *EncryptedFile) ReadAt(p []byte, off int64) (n int, err error) {
 	return
 }
 
+// pageRange returns the first and last pages touched by p at off, with the
+// offset of the start within the first page and of the end within the last
+func (f *EncryptedFile) pageRange(p []byte, off int64) (startPgNum, startPgOffset, endPgNum, endPgOffset int64) {
+	startPgNum = off / f.dataPgSize
+	startPgOffset = off % f.dataPgSize
+	end := off + int64(len(p))
+	endPgNum = (end - 1) / f.dataPgSize
+	endPgOffset = end - endPgNum*f.dataPgSize
+	return
+}
+
 // WriteAt implements WriterAt
 func (f *EncryptedFile) WriteAt(p []byte, off int64) (n int, err error) {
 	f.m.Lock()
 	defer f.m.Unlock()
+	return f.writeAt(p, off)
+}
+
+// writeAt writes p at off with the file locked
+func (f *EncryptedFile) writeAt(p []byte, off int64) (n int, err error) {
 	n = 0
-	startPgNum := off / dataPgSize
-	startPgOffset := off % dataPgSize
-	end := off + int64(len(p))
-	endPgNum := end / dataPgSize
-	endPgOffset := end % dataPgSize
+	if err = f.writable(); err != nil {
+		return
+	}
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	if len(p) == 0 {
+		return
+	}
+	dataPgSize := f.dataPgSize
+	startPgNum, startPgOffset, endPgNum, endPgOffset := f.pageRange(p, off)
+
+	// seal zero pages over any gap past the last stored page, since a hole
+	// in the file would fail authentication when read
+	if startPgNum > f.numPg {
+		var gap []page
+		gap, err = f.loadPages(f.numPg, startPgNum-1)
+		if err == nil {
+			err = f.storePages(gap)
+		}
+		if err != nil {
+			return
+		}
+	}
 
 	pages, err := f.loadPages(startPgNum, endPgNum)
 	if err != nil {
@@ -166,30 +758,126 @@ func (f *EncryptedFile) WriteAt(p []byte, off int64) (n int, err error) {
 				n += copy(pg.Data[:endPgOffset], p[n:])
 			} else {
 				// middle page
-				n += copy(pg.Data[:], p[n:n+dataPgSize])
+				n += copy(pg.Data[:], p[n:int64(n)+dataPgSize])
 			}
 		}
 	}
-	return n, f.writePages(pages)
+	// the size is set before the pages are stored, so that the journal
+	// records it along with them
+	size := f.hdr.Size
+	if off+int64(n) > f.hdr.Size {
+		f.hdr.Size = off + int64(n)
+	}
+	err = f.storePages(pages)
+	if err != nil {
+		f.hdr.Size = size
+		return
+	}
+	if f.journal != nil && f.journal.size > maxJournalSize {
+		// commit everything written so far, which empties the journal
+		err = f.flush()
+		if err == nil {
+			err = f.commitHeader()
+		}
+	}
+	return
+}
+
+// writable returns os.ErrClosed or ErrReadOnly if the file cannot be written
+func (f *EncryptedFile) writable() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.readOnly {
+		return ErrReadOnly
+	}
+	return nil
 }
 
-// Truncate implements StoreFile
+// wipePages clears decrypted page buffers once they are no longer needed
+func wipePages(pages []page) {
+	for _, pg := range pages {
+		keys.Wipe(pg.Data)
+	}
+}
+
+// storePages writes pages through to disk or into the write-back buffer,
+// taking ownership of their buffers
+func (f *EncryptedFile) storePages(pages []page) error {
+	if f.writeBack > 0 {
+		return f.bufferPages(pages)
+	}
+	return f.writePages(pages)
+}
+
+// Truncate implements StoreFile. Like os.File, it changes the size of the
+// file to exactly size bytes, and any bytes added by growing it read as zeros.
 func (f *EncryptedFile) Truncate(size int64) error {
 	f.m.Lock()
 	defer f.m.Unlock()
-	r := size % pgSize
-	var numPg int64
-	if r == 0 {
-		numPg = size / pgSize
-	} else {
-		numPg = (size / pgSize) + 1
+	if err := f.writable(); err != nil {
+		return err
+	}
+	if size < 0 {
+		return errNegativeSize
+	}
+	numPg := (size + f.dataPgSize - 1) / f.dataPgSize
+
+	// clear the tail of the new last page so it cannot reappear if the file
+	// grows again
+	if tail := size % f.dataPgSize; size < f.hdr.Size && tail != 0 && numPg <= f.numPg {
+		pages, err := f.loadPages(numPg-1, numPg-1)
+		if err != nil {
+			return err
+		}
+		data := pages[0].Data
+		for i := tail; i < int64(len(data)); i++ {
+			data[i] = 0
+		}
+		err = f.storePages(pages)
+		if err != nil {
+			return err
+		}
 	}
-	return f.file.Truncate(numPg * pgSize)
+
+	f.cache.truncate(numPg)
+	f.truncateDirty(numPg)
+	if f.tree != nil {
+		f.tree.truncate(numPg)
+	}
+	f.hdr.Size = size
+
+	if numPg < f.numPg {
+		f.numPg = numPg
+		if f.pmap != nil {
+			// the units of dropped pages are reused rather than cut off
+			f.pmap.truncate(numPg)
+			return nil
+		}
+		// the new size is committed before the pages are cut off, so a crash
+		// in between cannot bring back the old size over missing pages, and
+		// Open drops whatever is left past it
+		err := f.flush()
+		if err == nil {
+			err = f.commitHeader()
+		}
+		if err != nil {
+			return err
+		}
+		return f.file.Truncate(headerSize + numPg*f.pgSize)
+	}
+	return nil
+}
+
+// CacheStats returns hit and miss counts for the decrypted page cache
+func (f *EncryptedFile) CacheStats() CacheStats {
+	return f.cache.stats()
 }
 
 // FileInfo implements os.FileInfo
 type FileInfo struct {
-	fi os.FileInfo
+	fi   os.FileInfo
+	size int64
 }
 
 // Name implements FileInfo
@@ -199,9 +887,7 @@ func (e FileInfo) Name() string {
 
 // Size implements FileInfo
 func (e FileInfo) Size() int64 {
-	encryptedSize := e.fi.Size()
-	numPg := encryptedSize / pgSize
-	return dataPgSize * numPg
+	return e.size
 }
 
 // Mode implements FileInfo
@@ -230,5 +916,8 @@ func (f *EncryptedFile) Stat() (os.FileInfo, error) {
 	f.m.RLock()
 	defer f.m.RUnlock()
 	fileInfo, err := f.file.Stat()
-	return FileInfo{fi: fileInfo}, err
+	if err != nil {
+		return nil, err
+	}
+	return FileInfo{fi: fileInfo, size: f.hdr.Size}, nil
 }
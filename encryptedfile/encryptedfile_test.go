@@ -0,0 +1,1784 @@
+package encryptedfile
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/awans/fresnel/keys"
+	"github.com/awans/fresnel/suite"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const testPath = "test"
+
+var testKey = [32]byte{'t', 'e', 's', 't', 't', 'e', 's', 't', 't', 'e',
+	's', 't', 't', 'e', 's', 't', 't', 'e', 's', 't', 't', 'e', 's', 't',
+	't', 'e', 's', 't', 't', 'e', 's', 't'}
+
+func open(t *testing.T, opts ...Option) *EncryptedFile {
+	f, err := Open(testPath, testKey, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func cleanup(t *testing.T, f *EncryptedFile) {
+	err := f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.RemoveAll(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func randomBytes(t *testing.T, size int) []byte {
+	b := make([]byte, size)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestReadWriteRoundTrip(t *testing.T) {
+	f := open(t)
+	defer cleanup(t, f)
+
+	toWrite := randomBytes(t, DefaultPageSize*10+500)
+	_, err := f.WriteAt(toWrite, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toRead := make([]byte, len(toWrite))
+	_, err = f.ReadAt(toRead, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(toWrite, toRead) {
+		t.Fatal("read bytes do not match written bytes")
+	}
+}
+
+func TestSwappedPagesFailAuthentication(t *testing.T) {
+	f := open(t, CacheSize(0))
+	defer cleanup(t, f)
+
+	_, err := f.WriteAt(randomBytes(t, int(f.dataPgSize)*4), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// swap the two data pages on disk
+	first := make([]byte, f.pgSize)
+	second := make([]byte, f.pgSize)
+	f.file.ReadAt(first, headerSize)
+	f.file.ReadAt(second, headerSize+f.pgSize)
+	f.file.WriteAt(second, headerSize)
+	f.file.WriteAt(first, headerSize+f.pgSize)
+
+	_, err = f.ReadAt(make([]byte, 10), 0)
+	if err != (ErrCorruptPage{PageID: 0}) {
+		t.Fatalf("expected corrupt page 0, got %v", err)
+	}
+
+	// multi-page reads report the first bad page
+	_, err = f.ReadAt(make([]byte, f.dataPgSize*4), 0)
+	if err != (ErrCorruptPage{PageID: 0}) {
+		t.Fatalf("expected corrupt page 0, got %v", err)
+	}
+}
+
+func TestPageNamingAnotherKeyFailsCommitment(t *testing.T) {
+	f := open(t, CacheSize(0))
+	defer cleanup(t, f)
+
+	err := f.RotateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(randomBytes(t, 10), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// relabel the page as sealed with the older data key
+	var id [keyIDSize]byte
+	id[keyIDSize-1] = 1
+	f.file.WriteAt(id[:], headerSize)
+
+	_, err = f.ReadAt(make([]byte, 10), 0)
+	if err != (ErrKeyCommitment{PageID: 0}) {
+		t.Fatalf("expected a key commitment failure on page 0, got %v", err)
+	}
+}
+
+func TestPageFromOtherFileFailsAuthentication(t *testing.T) {
+	f := open(t, CacheSize(0))
+	defer cleanup(t, f)
+	_, err := f.WriteAt(randomBytes(t, 10), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := Open(testPath+"-other", testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testPath + "-other")
+	defer other.Close()
+	_, err = other.WriteAt(randomBytes(t, 10), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pg := make([]byte, f.pgSize)
+	other.file.ReadAt(pg, headerSize)
+	f.file.WriteAt(pg, headerSize)
+
+	_, err = f.ReadAt(make([]byte, 10), 0)
+	if err == nil {
+		t.Fatal("expected page from another file to fail authentication")
+	}
+}
+
+func TestOpenRejectsWrongKey(t *testing.T) {
+	f := open(t)
+	defer cleanup(t, f)
+
+	wrongKey := testKey
+	wrongKey[0] = 'x'
+	_, err := Open(testPath, wrongKey)
+	if err != ErrWrongKey {
+		t.Fatalf("expected ErrWrongKey, got %v", err)
+	}
+}
+
+func TestOpenRejectsForeignFile(t *testing.T) {
+	err := ioutil.WriteFile(testPath, randomBytes(t, headerSize), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testPath)
+	_, err = Open(testPath, testKey)
+	if err == nil {
+		t.Fatal("expected open of random bytes to fail")
+	}
+}
+
+func TestOpenRejectsTamperedHeader(t *testing.T) {
+	f := open(t)
+	defer cleanup(t, f)
+
+	f.hdr.KDF.Time++
+	f.file.WriteAt(f.hdr.encode(), int64(f.hdr.Generation%2)*headerSlotSize)
+	_, err := Open(testPath, testKey)
+	if err != ErrCorruptHeader {
+		t.Fatalf("expected ErrCorruptHeader, got %v", err)
+	}
+}
+
+func TestSingleWorker(t *testing.T) {
+	f := open(t, Workers(1))
+	defer cleanup(t, f)
+
+	toWrite := randomBytes(t, DefaultPageSize*10+500)
+	_, err := f.WriteAt(toWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toRead := make([]byte, len(toWrite))
+	_, err = f.ReadAt(toRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(toWrite, toRead) {
+		t.Fatal("read bytes do not match written bytes")
+	}
+}
+
+func TestPageSizeIsRecordedInFile(t *testing.T) {
+	f := open(t, PageSize(16384))
+	defer cleanup(t, f)
+
+	toWrite := randomBytes(t, 40000)
+	_, err := f.WriteAt(toWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reopening with a different page size option uses the recorded one
+	reopened, err := Open(testPath, testKey, PageSize(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if reopened.pgSize != 16384 {
+		t.Fatalf("expected page size 16384, got %d", reopened.pgSize)
+	}
+	toRead := make([]byte, len(toWrite))
+	_, err = reopened.ReadAt(toRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(toWrite, toRead) {
+		t.Fatal("read bytes do not match written bytes")
+	}
+}
+
+func TestCipherSuiteIsRecordedInFile(t *testing.T) {
+	for _, s := range []suite.Suite{suite.XChaCha20Poly1305, suite.AES256GCM, suite.AES256GCMSIV} {
+		f := open(t, Cipher(s))
+		toWrite := randomBytes(t, DefaultPageSize*3+100)
+		_, err := f.WriteAt(toWrite, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// reopening with a different suite option uses the recorded one
+		f = open(t, Cipher(suite.XChaCha20Poly1305))
+		if f.suite != s {
+			t.Fatalf("expected suite %s, got %s", s, f.suite)
+		}
+		toRead := make([]byte, len(toWrite))
+		_, err = f.ReadAt(toRead, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(toWrite, toRead) {
+			t.Fatalf("%s: read bytes do not match written bytes", s)
+		}
+		cleanup(t, f)
+	}
+}
+
+func TestInvalidPageSize(t *testing.T) {
+	_, err := Open(testPath, testKey, PageSize(5000))
+	if err == nil {
+		t.Fatal("expected invalid page size to be rejected")
+	}
+}
+
+func TestCacheServesRepeatedReads(t *testing.T) {
+	f := open(t)
+	defer cleanup(t, f)
+
+	toWrite := randomBytes(t, 100)
+	_, err := f.WriteAt(toWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toRead := make([]byte, len(toWrite))
+	for i := 0; i < 10; i++ {
+		_, err = f.ReadAt(toRead, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := f.CacheStats()
+	if stats.Hits < 10 {
+		t.Fatalf("expected repeated reads to hit the cache, got %+v", stats)
+	}
+
+	// writes must be visible through the cache
+	toWrite[5] ^= 0xff
+	_, err = f.WriteAt(toWrite[5:6], 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.ReadAt(toRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(toWrite, toRead) {
+		t.Fatal("read bytes do not match written bytes")
+	}
+}
+
+func TestCacheInvalidatedByTruncate(t *testing.T) {
+	f := open(t)
+	defer cleanup(t, f)
+
+	_, err := f.WriteAt(randomBytes(t, int(f.dataPgSize)*3), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Truncate(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Truncate(f.dataPgSize * 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toRead := make([]byte, 10)
+	_, err = f.ReadAt(toRead, f.dataPgSize*2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(toRead, make([]byte, 10)) {
+		t.Fatal("expected truncated page to read as zeros")
+	}
+}
+
+// TestMatchesOSFile applies the same writes and truncates to an
+// EncryptedFile and an os.File and checks that sizes and contents agree
+func TestMatchesOSFile(t *testing.T) {
+	matchesOSFile(t, PageSize(MinPageSize))
+}
+
+func TestCompressedMatchesOSFile(t *testing.T) {
+	matchesOSFile(t, PageSize(MinPageSize), Compress(Snappy))
+}
+
+// matchesOSFile checks that writes and truncations read back as they do from
+// an os.File
+func matchesOSFile(t *testing.T, opts ...Option) {
+	f := open(t, opts...)
+	defer cleanup(t, f)
+	plain, err := os.Create(testPath + "-plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testPath + "-plain")
+	defer plain.Close()
+
+	check := func() {
+		fi, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pfi, err := plain.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != pfi.Size() {
+			t.Fatalf("size %d does not match os.File size %d", fi.Size(), pfi.Size())
+		}
+		want := make([]byte, pfi.Size()+10)
+		got := make([]byte, pfi.Size()+10)
+		wn, werr := plain.ReadAt(want, 0)
+		gn, gerr := f.ReadAt(got, 0)
+		if wn != gn || werr != gerr || !bytes.Equal(want, got) {
+			t.Fatalf("read (%d, %v) does not match os.File read (%d, %v)", gn, gerr, wn, werr)
+		}
+	}
+
+	ops := []struct {
+		off      int64
+		size     int
+		truncate bool
+	}{
+		{0, 10, false},
+		{5, 3000, false},
+		{0, 1000, true},
+		{1500, 0, true},
+		{1200, 10, false},
+		{777, 0, true},
+		{5000, 1, false},
+		{9000, 0, true},
+		{8000, 100, false},
+		{20000, 0, true},
+		{15000, 0, true},
+		{16000, 10, false},
+		{0, 0, true},
+	}
+	for _, op := range ops {
+		if op.truncate {
+			err = f.Truncate(op.off)
+			if err == nil {
+				err = plain.Truncate(op.off)
+			}
+		} else {
+			b := randomBytes(t, op.size)
+			_, err = f.WriteAt(b, op.off)
+			if err == nil {
+				_, err = plain.WriteAt(b, op.off)
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		check()
+	}
+}
+
+func TestSizeIsPersisted(t *testing.T) {
+	f := open(t)
+	defer cleanup(t, f)
+
+	_, err := f.WriteAt(randomBytes(t, 1234), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(testPath, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	fi, err := reopened.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 1234 {
+		t.Fatalf("expected size 1234, got %d", fi.Size())
+	}
+}
+
+func TestWriteBackBuffersUntilSync(t *testing.T) {
+	f := open(t, WriteBack(1<<20))
+	defer cleanup(t, f)
+
+	toWrite := randomBytes(t, 10000)
+	for off := 0; off < len(toWrite); off += 100 {
+		_, err := f.WriteAt(toWrite[off:off+100], int64(off))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fi, err := f.file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != headerSize {
+		t.Fatalf("expected no pages on disk before sync, got %d bytes", fi.Size())
+	}
+	efi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if efi.Size() < int64(len(toWrite)) {
+		t.Fatalf("expected buffered pages to count towards size, got %d", efi.Size())
+	}
+
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(testPath, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	toRead := make([]byte, len(toWrite))
+	_, err = reopened.ReadAt(toRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(toWrite, toRead) {
+		t.Fatal("read bytes do not match written bytes")
+	}
+}
+
+func TestRollbackProtection(t *testing.T) {
+	f := open(t, RollbackProtection(), CacheSize(0))
+	defer cleanup(t, f)
+
+	_, err := f.WriteAt(randomBytes(t, 10), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldRoot := f.Root()
+	oldPg := make([]byte, f.pgSize)
+	f.file.ReadAt(oldPg, headerSize)
+
+	_, err = f.WriteAt(randomBytes(t, 10), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Root() == oldRoot {
+		t.Fatal("expected root to change after write")
+	}
+
+	// an older copy of the page is rejected while open
+	f.file.WriteAt(oldPg, headerSize)
+	_, err = f.ReadAt(make([]byte, 10), 0)
+	if err != (ErrCorruptPage{PageID: 0}) {
+		t.Fatalf("expected corrupt page 0, got %v", err)
+	}
+
+	// and on open
+	_, err = Open(testPath, testKey)
+	if err != ErrRollback {
+		t.Fatalf("expected ErrRollback, got %v", err)
+	}
+}
+
+func TestPinnedRoot(t *testing.T) {
+	f := open(t, RollbackProtection())
+	defer cleanup(t, f)
+
+	_, err := f.WriteAt(randomBytes(t, 10), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(testPath, testKey, PinRoot(f.Root()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.Close()
+
+	_, err = Open(testPath, testKey, PinRoot([32]byte{1}))
+	if err != ErrRollback {
+		t.Fatalf("expected ErrRollback, got %v", err)
+	}
+}
+
+func TestMerkleTreeIncrementalMatchesRebuild(t *testing.T) {
+	tree := newMerkleTree()
+	for i := int64(0); i < 37; i++ {
+		tree.set(i, leafHash([]byte{byte(i)}))
+		tree.set(i/2, leafHash([]byte{byte(i), 1}))
+		want := &merkleTree{levels: [][][32]byte{append([][32]byte(nil), tree.levels[0]...)}}
+		want.rebuild()
+		if tree.root() != want.root() {
+			t.Fatalf("incremental root differs from rebuilt root at %d leaves", i+1)
+		}
+	}
+}
+
+func TestMerkleTreePrefixRoot(t *testing.T) {
+	tree := newMerkleTree()
+	for i := int64(0); i < 37; i++ {
+		tree.set(i, leafHash([]byte{byte(i)}))
+	}
+	for n := int64(0); n <= 38; n++ {
+		want := newMerkleTree()
+		for i := int64(0); i < n && i < 37; i++ {
+			want.set(i, tree.leaf(i))
+		}
+		if tree.prefixRoot(n) != want.root() {
+			t.Fatalf("prefix root differs from the root of the first %d leaves", n)
+		}
+	}
+}
+
+func TestRekey(t *testing.T) {
+	f := open(t, PageSize(MinPageSize))
+	defer cleanup(t, f)
+
+	toWrite := randomBytes(t, MinPageSize*(rekeyBatch+50))
+	_, err := f.WriteAt(toWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey := testKey
+	newKey[0] = 'n'
+	err = f.Rekey(newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open(testPath, testKey)
+	if err != ErrWrongKey {
+		t.Fatalf("expected ErrWrongKey for old key, got %v", err)
+	}
+	reopened, err := Open(testPath, newKey, CacheSize(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	toRead := make([]byte, len(toWrite))
+	_, err = reopened.ReadAt(toRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(toWrite, toRead) {
+		t.Fatal("read bytes do not match written bytes")
+	}
+}
+
+func TestRekeyResume(t *testing.T) {
+	f := open(t, PageSize(MinPageSize))
+	defer os.RemoveAll(testPath)
+
+	toWrite := randomBytes(t, MinPageSize*(rekeyBatch+50))
+	_, err := f.WriteAt(toWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey := testKey
+	newKey[0] = 'n'
+	err = f.startRekey(newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.rekeyStep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// simulate a crash after the next batch is written but before the
+	// header records it
+	pages, err := f.loadPages(rekeyBatch, rekeyBatch+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.hdr.RekeyProgress += 11
+	err = f.writePages(pages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.file.Close()
+
+	_, err = Open(testPath, testKey)
+	if err != ErrRekeyInProgress {
+		t.Fatalf("expected ErrRekeyInProgress, got %v", err)
+	}
+	resumed, err := Open(testPath, testKey, ResumeRekey(newKey), CacheSize(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	toRead := make([]byte, len(toWrite))
+	_, err = resumed.ReadAt(toRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(toWrite, toRead) {
+		t.Fatal("read bytes do not match written bytes")
+	}
+	err = resumed.Rekey(newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed.Close()
+
+	reopened, err := Open(testPath, newKey, CacheSize(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	_, err = reopened.ReadAt(toRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(toWrite, toRead) {
+		t.Fatal("read bytes do not match written bytes")
+	}
+}
+
+func TestMultipleKeys(t *testing.T) {
+	f := open(t)
+	defer cleanup(t, f)
+
+	toWrite := randomBytes(t, 100)
+	_, err := f.WriteAt(toWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey := testKey
+	otherKey[0] = 'o'
+	err = f.AddKey(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range [][32]byte{testKey, otherKey} {
+		reopened, err := Open(testPath, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		toRead := make([]byte, len(toWrite))
+		_, err = reopened.ReadAt(toRead, 0)
+		reopened.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(toWrite, toRead) {
+			t.Fatal("read bytes do not match written bytes")
+		}
+	}
+
+	err = f.RemoveKey(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(testPath, testKey)
+	if err != ErrWrongKey {
+		t.Fatalf("expected ErrWrongKey for removed key, got %v", err)
+	}
+	err = f.RemoveKey(otherKey)
+	if err == nil {
+		t.Fatal("expected removing the last key to fail")
+	}
+}
+
+// testKDF is cheap enough for tests; real files use keys.NewKDFParams
+var testKDF = keys.KDFParams{Algorithm: keys.KDFArgon2id, Time: 1, Memory: 64, Threads: 1}
+
+func TestPassphrase(t *testing.T) {
+	f, err := OpenPassphrase(testPath, []byte("correct horse"), KDF(testKDF))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup(t, f)
+
+	toWrite := randomBytes(t, 100)
+	_, err = f.WriteAt(toWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.AddPassphrase([]byte("battery staple"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, passphrase := range []string{"correct horse", "battery staple"} {
+		reopened, err := OpenPassphrase(testPath, []byte(passphrase))
+		if err != nil {
+			t.Fatal(err)
+		}
+		toRead := make([]byte, len(toWrite))
+		_, err = reopened.ReadAt(toRead, 0)
+		reopened.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(toWrite, toRead) {
+			t.Fatal("read bytes do not match written bytes")
+		}
+	}
+
+	_, err = OpenPassphrase(testPath, []byte("wrong"))
+	if err != ErrWrongKey {
+		t.Fatalf("expected ErrWrongKey, got %v", err)
+	}
+	err = f.RemovePassphrase([]byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenPassphrase(testPath, []byte("correct horse"))
+	if err != ErrWrongKey {
+		t.Fatalf("expected ErrWrongKey for removed passphrase, got %v", err)
+	}
+}
+
+func TestFailedAddPassphraseLeavesKDF(t *testing.T) {
+	f := open(t)
+	defer cleanup(t, f)
+	for i := 1; i < maxWrappedKeys; i++ {
+		key := testKey
+		key[0] = byte(i)
+		err := f.AddKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := f.AddPassphrase([]byte("correct horse"))
+	if err == nil {
+		t.Fatal("expected adding a key to a full file to fail")
+	}
+	if f.hdr.KDF.Algorithm != keys.KDFNone {
+		t.Fatal("expected no key derivation parameters without a passphrase key")
+	}
+}
+
+func TestOpenPassphraseRejectsRawKeyFile(t *testing.T) {
+	f := open(t)
+	defer cleanup(t, f)
+
+	_, err := OpenPassphrase(testPath, []byte("correct horse"))
+	if err != ErrNoPassphrase {
+		t.Fatalf("expected ErrNoPassphrase, got %v", err)
+	}
+}
+
+func TestOpenProviderRawKeyRecordsNoKDF(t *testing.T) {
+	f, err := OpenProvider(testPath, keys.StaticKey(testKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup(t, f)
+	if f.hdr.KDF.Algorithm != keys.KDFNone {
+		t.Fatal("expected no key derivation parameters for a raw key")
+	}
+
+	_, err = OpenPassphrase(testPath, []byte("correct horse"))
+	if err != ErrNoPassphrase {
+		t.Fatalf("expected ErrNoPassphrase, got %v", err)
+	}
+}
+
+func TestRotateAndRetireDataKeys(t *testing.T) {
+	f := open(t, PageSize(MinPageSize), CacheSize(0))
+	defer cleanup(t, f)
+
+	toWrite := randomBytes(t, int(f.dataPgSize)*(rekeyBatch+20))
+	_, err := f.WriteAt(toWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.RotateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rewrite one page under the new key
+	_, err = f.WriteAt(toWrite[:10], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pgID, want := range map[int64]uint32{0: 2, 1: 1, rekeyBatch + 10: 1} {
+		id, err := f.pageKeyID(pgID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != want {
+			t.Fatalf("expected page %d under key %d, got %d", pgID, want, id)
+		}
+	}
+
+	err = f.RetireDataKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pgID := int64(0); pgID < f.numPg; pgID++ {
+		id, err := f.pageKeyID(pgID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 2 {
+			t.Fatalf("expected page %d to be rewritten under key 2, got %d", pgID, id)
+		}
+	}
+	if len(f.ringKeys) != 1 {
+		t.Fatalf("expected one data key left, got %d", len(f.ringKeys))
+	}
+
+	reopened, err := Open(testPath, testKey, CacheSize(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	toRead := make([]byte, len(toWrite))
+	_, err = reopened.ReadAt(toRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(toWrite, toRead) {
+		t.Fatal("read bytes do not match written bytes")
+	}
+}
+
+func TestKeyRingIsBounded(t *testing.T) {
+	f := open(t)
+	defer cleanup(t, f)
+
+	for i := 1; i < maxRingKeys; i++ {
+		err := f.RotateDataKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := f.RotateDataKey()
+	if err == nil {
+		t.Fatal("expected a full key ring to refuse another key")
+	}
+	err = f.RetireDataKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.RotateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseWipesKeys(t *testing.T) {
+	f := open(t)
+	defer os.RemoveAll(testPath)
+
+	_, err := f.WriteAt(randomBytes(t, 100), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *f.key != ([32]byte{}) || *f.kek != ([32]byte{}) || len(f.ringKeys) != 0 {
+		t.Fatal("expected Close to wipe the keys")
+	}
+	if stats := f.CacheStats(); stats.Pages != 0 {
+		t.Fatalf("expected Close to empty the cache, got %+v", stats)
+	}
+	_, err = f.ReadAt(make([]byte, 100), 0)
+	if err != os.ErrClosed {
+		t.Fatalf("expected a read after Close to fail, got %v", err)
+	}
+	_, err = f.WriteAt([]byte("x"), 0)
+	if err != os.ErrClosed {
+		t.Fatalf("expected a write after Close to fail, got %v", err)
+	}
+	if f.Close() != os.ErrClosed {
+		t.Fatal("expected a second Close to fail")
+	}
+}
+
+func TestCacheEvictionWipesPages(t *testing.T) {
+	c := newPageCache(8)
+	c.put(0, []byte("plaintxt"))
+	data := c.items[0].Value.(*cacheEntry).data
+	c.put(1, []byte("evicting"))
+	if !bytes.Equal(data, make([]byte, 8)) {
+		t.Fatal("expected an evicted page to be wiped")
+	}
+}
+
+func compressible(size int) []byte {
+	b := bytes.Repeat([]byte(`{"name": "patient", "status": "admitted"} `), size/41+1)
+	return b[:size]
+}
+
+func TestCompression(t *testing.T) {
+	toWrite := append(compressible(DefaultPageSize*20), randomBytes(t, DefaultPageSize*2)...)
+	for _, c := range []Compression{Snappy, Flate} {
+		f := open(t, Compress(c))
+		_, err := f.WriteAt(toWrite, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(testPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > headerSize+int64(len(toWrite))/2 {
+			t.Fatalf("%s: expected the file to be compressed, got %d bytes", c, fi.Size())
+		}
+
+		// reopening with a different compression option uses the recorded one
+		f = open(t, Compress(NoCompression))
+		if Compression(f.hdr.Compression) != c {
+			t.Fatalf("expected compression %s, got %s", c, Compression(f.hdr.Compression))
+		}
+		toRead := make([]byte, len(toWrite))
+		_, err = f.ReadAt(toRead, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(toWrite, toRead) {
+			t.Fatalf("%s: read bytes do not match written bytes", c)
+		}
+		cleanup(t, f)
+	}
+}
+
+func TestCompressedRewritesReuseSpace(t *testing.T) {
+	f := open(t, Compress(Snappy))
+	defer cleanup(t, f)
+
+	toWrite := compressible(DefaultPageSize * 8)
+	var size int64
+	for i := 0; i < 20; i++ {
+		toWrite[i] = 'x'
+		_, err := f.WriteAt(toWrite, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Sync()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(testPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			size = fi.Size()
+		} else if i > 1 && fi.Size() > size {
+			t.Fatalf("expected rewrites to reuse freed space, file grew from %d to %d bytes", size, fi.Size())
+		}
+	}
+	toRead := make([]byte, len(toWrite))
+	_, err := f.ReadAt(toRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(toWrite, toRead) {
+		t.Fatal("read bytes do not match written bytes")
+	}
+}
+
+func TestCompressedRollbackProtection(t *testing.T) {
+	f := open(t, Compress(Flate), RollbackProtection())
+	toWrite := compressible(DefaultPageSize * 5)
+	_, err := f.WriteAt(toWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f = open(t)
+	defer cleanup(t, f)
+	if f.tree == nil || f.tree.numLeaves() != f.numPg {
+		t.Fatal("expected a Merkle tree over every page")
+	}
+	toRead := make([]byte, len(toWrite))
+	_, err = f.ReadAt(toRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(toWrite, toRead) {
+		t.Fatal("read bytes do not match written bytes")
+	}
+}
+
+func TestReadWriteSeek(t *testing.T) {
+	f := open(t)
+	defer cleanup(t, f)
+
+	toWrite := randomBytes(t, DefaultPageSize*3+100)
+	for i := 0; i < len(toWrite); i += 1000 {
+		end := i + 1000
+		if end > len(toWrite) {
+			end = len(toWrite)
+		}
+		_, err := f.Write(toWrite[i:end])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	off, err := f.Seek(0, io.SeekStart)
+	if err != nil || off != 0 {
+		t.Fatalf("expected to seek to 0, got %d, %v", off, err)
+	}
+	toRead, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(toWrite, toRead) {
+		t.Fatal("read bytes do not match written bytes")
+	}
+	n, err := f.Read(make([]byte, 10))
+	if n != 0 || err != io.EOF {
+		t.Fatalf("expected io.EOF at the end of the file, got %d, %v", n, err)
+	}
+
+	off, err = f.Seek(-100, io.SeekEnd)
+	if err != nil || off != int64(len(toWrite))-100 {
+		t.Fatalf("expected to seek to %d, got %d, %v", len(toWrite)-100, off, err)
+	}
+	off, err = f.Seek(50, io.SeekCurrent)
+	if err != nil || off != int64(len(toWrite))-50 {
+		t.Fatalf("expected to seek to %d, got %d, %v", len(toWrite)-50, off, err)
+	}
+	toRead, err = ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(toWrite[len(toWrite)-50:], toRead) {
+		t.Fatal("read bytes do not match written bytes")
+	}
+	_, err = f.Seek(-1, io.SeekStart)
+	if err == nil {
+		t.Fatal("expected a negative offset to be rejected")
+	}
+}
+
+func TestAppend(t *testing.T) {
+	f := open(t, Append())
+	defer cleanup(t, f)
+
+	_, err := f.WriteAt([]byte("hello"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte(" world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	toRead := make([]byte, 11)
+	_, err = f.ReadAt(toRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(toRead) != "hello world" {
+		t.Fatalf("expected writes to append, got %q", toRead)
+	}
+}
+
+func TestReadFromWriteTo(t *testing.T) {
+	f := open(t)
+	defer cleanup(t, f)
+
+	toWrite := randomBytes(t, DefaultPageSize*streamPages*2+100)
+	n, err := io.Copy(f, bytes.NewReader(toWrite))
+	if err != nil || n != int64(len(toWrite)) {
+		t.Fatalf("expected to copy %d bytes in, got %d, %v", len(toWrite), n, err)
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	n, err = io.Copy(&buf, f)
+	if err != nil || n != int64(len(toWrite)) {
+		t.Fatalf("expected to copy %d bytes out, got %d, %v", len(toWrite), n, err)
+	}
+	if !bytes.Equal(toWrite, buf.Bytes()) {
+		t.Fatal("copied bytes do not match written bytes")
+	}
+}
+
+// crash abandons an open file without flushing, syncing or emptying its
+// journal
+func crash(f *EncryptedFile) {
+	f.file.Close()
+	f.journal.file.Close()
+}
+
+func TestJournalRestoresTornWrite(t *testing.T) {
+	f := open(t)
+	defer os.RemoveAll(testPath)
+
+	_, err := f.WriteAt(randomBytes(t, DefaultPageSize*3), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	toWrite := randomBytes(t, DefaultPageSize*3)
+	_, err = f.WriteAt(toWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tear the second page, as a crash mid-write would
+	_, err = f.file.WriteAt(make([]byte, 100), headerSize+f.pgSize+50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(f)
+
+	f = open(t)
+	defer f.Close()
+	toRead := make([]byte, len(toWrite))
+	_, err = f.ReadAt(toRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(toWrite, toRead) {
+		t.Fatal("expected the journal to restore the interrupted write")
+	}
+}
+
+func TestJournalDiscardsTornTransaction(t *testing.T) {
+	f := open(t)
+	defer os.RemoveAll(testPath)
+
+	toWrite := randomBytes(t, DefaultPageSize*3)
+	_, err := f.WriteAt(toWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	synced, err := ioutil.ReadFile(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(randomBytes(t, DefaultPageSize*3), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a crash while the journal was being written leaves the file untouched
+	// and the transaction incomplete
+	_, err = f.file.WriteAt(synced, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.journal.file.Truncate(f.journal.size - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(f)
+
+	f = open(t)
+	toRead := make([]byte, len(toWrite))
+	_, err = f.ReadAt(toRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(toWrite, toRead) {
+		t.Fatal("expected the torn transaction to be discarded")
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(testPath + journalSuffix)
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected Close to remove the empty journal, got %v", err)
+	}
+}
+
+func TestJournalRestoresWritePastEnd(t *testing.T) {
+	for _, opts := range [][]Option{nil, {RollbackProtection()}} {
+		f := open(t, opts...)
+		expected := randomBytes(t, 100)
+		_, err := f.WriteAt(expected, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Sync()
+		if err != nil {
+			t.Fatal(err)
+		}
+		toWrite := randomBytes(t, 200)
+		_, err = f.WriteAt(toWrite, 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected[:50], toWrite...)
+		crash(f)
+
+		f = open(t)
+		fi, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != int64(len(expected)) {
+			t.Fatalf("expected size %d, got %d", len(expected), fi.Size())
+		}
+		toRead := make([]byte, len(expected))
+		_, err = f.ReadAt(toRead, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected, toRead) {
+			t.Fatal("expected the journal to restore the write past the end")
+		}
+		cleanup(t, f)
+	}
+}
+
+func TestTruncateSurvivesCrash(t *testing.T) {
+	f := open(t, RollbackProtection())
+	defer os.RemoveAll(testPath)
+	toWrite := randomBytes(t, 20000)
+	_, err := f.WriteAt(toWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Truncate(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a crash before the pages were cut off leaves them on disk
+	_, err = f.file.WriteAt(before[headerSize+f.pgSize:], headerSize+f.pgSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(f)
+
+	f = open(t)
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 100 {
+		t.Fatalf("expected size 100, got %d", fi.Size())
+	}
+	toRead := make([]byte, 100)
+	_, err = f.ReadAt(toRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(toWrite[:100], toRead) {
+		t.Fatal("expected the truncated file to keep its first 100 bytes")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	f := open(t)
+	defer cleanup(t, f)
+
+	_, err := f.WriteAt(randomBytes(t, DefaultPageSize*5), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := f.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Pages != f.numPg {
+		t.Fatalf("expected %d intact pages, got %d with faults %v", f.numPg, report.Pages, report.Faults)
+	}
+
+	// flip a byte of page 1, name a missing data key on page 2 and cut the
+	// last page short
+	var b [1]byte
+	_, err = f.file.ReadAt(b[:], headerSize+f.pgSize+100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 1
+	_, err = f.file.WriteAt(b[:], headerSize+f.pgSize+100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.file.WriteAt([]byte{0, 0, 0, 99}, headerSize+2*f.pgSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := f.numPg - 1
+	err = f.file.Truncate(headerSize + last*f.pgSize + 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = f.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []PageFault{{1, Corrupt}, {2, WrongKey}, {last, Truncated}}
+	if len(report.Faults) != len(expected) {
+		t.Fatalf("expected faults %v, got %v", expected, report.Faults)
+	}
+	for i, fault := range expected {
+		if report.Faults[i] != fault {
+			t.Fatalf("expected faults %v, got %v", expected, report.Faults)
+		}
+	}
+}
+
+func TestVerifyFindsRolledBackPage(t *testing.T) {
+	f := open(t, RollbackProtection())
+	defer cleanup(t, f)
+
+	_, err := f.WriteAt(randomBytes(t, DefaultPageSize*2), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := make([]byte, f.pgSize)
+	_, err = f.file.ReadAt(old, headerSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(randomBytes(t, 100), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.file.WriteAt(old, headerSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := f.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Faults) != 1 || report.Faults[0] != (PageFault{0, RolledBack}) {
+		t.Fatalf("expected page 0 to be rolled back, got %v", report.Faults)
+	}
+}
+
+func TestVerifyOnlyOpensRolledBackFile(t *testing.T) {
+	f := open(t, RollbackProtection())
+	defer os.RemoveAll(testPath)
+	_, err := f.WriteAt(randomBytes(t, DefaultPageSize*3), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := make([]byte, f.pgSize)
+	_, err = f.file.ReadAt(old, headerSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(randomBytes(t, 100), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// roll back page 0 and corrupt page 2
+	file, err := os.OpenFile(testPath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt(old, headerSize)
+	file.WriteAt([]byte{0xff}, headerSize+2*DefaultPageSize+100)
+	file.Close()
+
+	_, err = Open(testPath, testKey)
+	if err != ErrRollback {
+		t.Fatalf("expected ErrRollback, got %v", err)
+	}
+	f = open(t, VerifyOnly())
+	defer f.Close()
+	report, err := f.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.RolledBack || report.OK() {
+		t.Fatal("expected the report to show the file was rolled back")
+	}
+	if len(report.Faults) != 1 || report.Faults[0] != (PageFault{2, Corrupt}) {
+		t.Fatalf("expected page 2 to be corrupt, got %v", report.Faults)
+	}
+	_, err = f.WriteAt([]byte("hi"), 0)
+	if err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	f := open(t)
+	defer os.RemoveAll(testPath)
+	toWrite := randomBytes(t, DefaultPageSize*3)
+	_, err := f.WriteAt(toWrite, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f = open(t, ReadOnly())
+	toRead := make([]byte, len(toWrite))
+	_, err = f.ReadAt(toRead, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(toWrite, toRead) {
+		t.Fatal("expected to read what was written")
+	}
+	_, err = f.WriteAt([]byte("hi"), 0)
+	if err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly from WriteAt, got %v", err)
+	}
+	_, err = f.Write([]byte("hi"))
+	if err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly from Write, got %v", err)
+	}
+	err = f.Truncate(0)
+	if err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly from Truncate, got %v", err)
+	}
+	err = f.AddKey([32]byte{1})
+	if err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly from AddKey, got %v", err)
+	}
+	err = f.RotateDataKey()
+	if err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly from RotateDataKey, got %v", err)
+	}
+	err = f.Rekey([32]byte{1})
+	if err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly from Rekey, got %v", err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := ioutil.ReadFile(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatal("expected a read-only open to leave the file untouched")
+	}
+	_, err = os.Stat(testPath + journalSuffix)
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected no journal, got %v", err)
+	}
+}
+
+func TestReadOnlyRejectsPendingJournal(t *testing.T) {
+	f := open(t)
+	defer os.RemoveAll(testPath)
+	_, err := f.WriteAt(randomBytes(t, DefaultPageSize*3), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(randomBytes(t, DefaultPageSize), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(f)
+
+	_, err = Open(testPath, testKey, ReadOnly())
+	if err != ErrJournalPending {
+		t.Fatalf("expected ErrJournalPending, got %v", err)
+	}
+	f = open(t)
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f = open(t, ReadOnly())
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenFlags(t *testing.T) {
+	defer os.RemoveAll(testPath)
+	for _, opt := range []Option{ReadOnly(), MustExist()} {
+		_, err := Open(testPath, testKey, opt)
+		if !os.IsNotExist(err) {
+			t.Fatalf("expected a missing file to be an error, got %v", err)
+		}
+	}
+	_, err := os.Stat(testPath)
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected no file to be created, got %v", err)
+	}
+
+	f := open(t, Exclusive())
+	fi, err := os.Stat(testPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected mode 0600, got %v", fi.Mode().Perm())
+	}
+	fi, err = os.Stat(testPath + journalSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected journal mode 0600, got %v", fi.Mode().Perm())
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open(testPath, testKey, Exclusive())
+	if !os.IsExist(err) {
+		t.Fatalf("expected an existing file to be an error, got %v", err)
+	}
+	f = open(t, MustExist())
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(testPath, testKey, Exclusive(), ReadOnly())
+	if err == nil {
+		t.Fatal("expected an exclusive read-only open to be rejected")
+	}
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	defer os.RemoveAll(testPath)
+	data := randomBytes(t, 3*legacyDataPgSize)
+	var legacy []byte
+	for i := 0; i < 3; i++ {
+		var nonce [legacyNonceSize]byte
+		_, err := rand.Read(nonce[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		pg := data[i*legacyDataPgSize : (i+1)*legacyDataPgSize]
+		legacy = secretbox.Seal(append(legacy, nonce[:]...), pg, &nonce, &testKey)
+	}
+	err := ioutil.WriteFile(testPath, legacy, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open(testPath, testKey)
+	if err != ErrLegacyFormat {
+		t.Fatalf("expected ErrLegacyFormat, got %v", err)
+	}
+	_, err = OpenProvider(testPath, keys.StaticKey(testKey))
+	if err != ErrLegacyFormat {
+		t.Fatalf("expected ErrLegacyFormat from OpenProvider, got %v", err)
+	}
+	err = MigrateLegacy(testPath, [32]byte{1})
+	if err == nil {
+		t.Fatal("expected migrating with the wrong key to be an error")
+	}
+
+	err = MigrateLegacy(testPath, testKey, Cipher(suite.AES256GCM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := open(t)
+	defer cleanup(t, f)
+	got := make([]byte, len(data))
+	_, err = f.ReadAt(got, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("migrated file does not match the legacy one")
+	}
+	if f.suite != suite.AES256GCM {
+		t.Fatal("expected the migrated file to use the given cipher suite")
+	}
+}
+
+func TestJournalSkipsAppends(t *testing.T) {
+	f := open(t)
+	defer cleanup(t, f)
+	for i := 0; i < 2000; i++ {
+		_, err := f.Write(randomBytes(t, 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f.journal.size != 0 {
+		t.Fatalf("expected appends to leave the journal empty, got %d bytes", f.journal.size)
+	}
+}
+
+func TestJournalIsBounded(t *testing.T) {
+	f := open(t)
+	defer cleanup(t, f)
+	_, err := f.WriteAt(randomBytes(t, int(f.dataPgSize)*16), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn := int64(journalHeaderSize + 8 + f.pgSize + 32)
+	var last []byte
+	for i := int64(0); i < 3*maxJournalSize/txn; i++ {
+		last = randomBytes(t, 10)
+		_, err = f.WriteAt(last, (i%16)*f.dataPgSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.journal.size > maxJournalSize+txn {
+			t.Fatalf("expected the journal to stay under %d bytes, got %d", maxJournalSize, f.journal.size)
+		}
+	}
+	toRead := make([]byte, len(last))
+	_, err = f.ReadAt(toRead, ((3*maxJournalSize/txn-1)%16)*f.dataPgSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(last, toRead) {
+		t.Fatal("expected to read back the last overwrite")
+	}
+}
+
+func TestJournalRecoversOverwriteWithAppend(t *testing.T) {
+	for _, opts := range [][]Option{nil, {RollbackProtection()}} {
+		f := open(t, opts...)
+		expected := randomBytes(t, 100)
+		_, err := f.WriteAt(expected, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Sync()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// overwrite the synced page and append three more, which are lost
+		toWrite := randomBytes(t, int(f.dataPgSize)*4-50)
+		_, err = f.WriteAt(toWrite, 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected[:50], toWrite[:f.dataPgSize-50]...)
+		crash(f)
+
+		f = open(t)
+		fi, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != int64(len(expected)) {
+			t.Fatalf("expected size %d, got %d", len(expected), fi.Size())
+		}
+		toRead := make([]byte, len(expected))
+		_, err = f.ReadAt(toRead, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected, toRead) {
+			t.Fatal("expected the journal to restore the overwritten page")
+		}
+		cleanup(t, f)
+	}
+}
@@ -0,0 +1,59 @@
+package encryptedfile
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrWrongKey is returned by Open when the key does not match the one the
+// file was written with
+var ErrWrongKey = errors.New("wrong key")
+
+// ErrCorruptHeader is returned by Open when the header was written with the
+// right key but has since been modified
+var ErrCorruptHeader = errors.New("file header failed authentication")
+
+// ErrReadOnly is returned when writing to or changing the keys of a file
+// opened with ReadOnly
+var ErrReadOnly = errors.New("file is open read-only")
+
+// ErrJournalPending is returned by Open with ReadOnly when a crash left
+// writes in the file's journal. Opening the file for writing replays them.
+var ErrJournalPending = errors.New("journal has writes to replay; open the file for writing first")
+
+// ErrLegacyFormat is returned by Open for a file written before files had a
+// header, as bare secretbox pages sealed with the key itself. MigrateLegacy
+// rewrites such a file in the current format.
+var ErrLegacyFormat = errors.New("file is in the legacy headerless format; migrate it with MigrateLegacy")
+
+var errNoHeader = errors.New("not an encrypted file")
+var errNegativeOffset = errors.New("negative offset")
+var errNegativeSize = errors.New("negative size")
+var errEmptyReadOnly = errors.New("cannot create a file opened read-only")
+
+// ErrRollback is returned by Open when pages on disk do not match the Merkle
+// root in the header, or the root does not match the pinned one. Either some
+// pages or the whole file were replaced with older copies, or the file was
+// not synced after its last write.
+var ErrRollback = errors.New("file was rolled back or modified")
+
+// ErrCorruptPage is returned when a page fails authentication, which means it
+// was modified, moved from another position or file, or torn by a crash
+type ErrCorruptPage struct {
+	PageID int64
+}
+
+func (e ErrCorruptPage) Error() string {
+	return fmt.Sprintf("page %d failed authentication", e.PageID)
+}
+
+// ErrKeyCommitment is returned when a page is not committed to the data key
+// it names, which means it was modified or crafted to open under more than
+// one key
+type ErrKeyCommitment struct {
+	PageID int64
+}
+
+func (e ErrKeyCommitment) Error() string {
+	return fmt.Sprintf("page %d failed its key commitment check", e.PageID)
+}
@@ -0,0 +1,225 @@
+package encryptedfile
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/awans/fresnel/keys"
+	"github.com/awans/fresnel/suite"
+)
+
+// The header region at the start of every file holds two header slots of a
+// fixed size, independent of the page size recorded inside them. Updates
+// alternate between the slots, so a torn header write leaves the previous
+// generation readable.
+const headerSlotSize = 4096
+const headerSize = 2 * headerSlotSize
+
+const formatVersion = 1
+
+var magic = [8]byte{'F', 'R', 'E', 'S', 'N', 'E', 'L', 0}
+
+// Header flags
+const (
+	// flagMerkle means Root holds a Merkle root over every page
+	flagMerkle uint32 = 1 << iota
+	// flagRekey means the file key is being rotated to the one in
+	// NextWrapped, and pages before RekeyProgress have been rewritten with
+	// the newest data key
+	flagRekey
+	// flagCommitted means every page carries a commitment to its data key
+	// after the nonce
+	flagCommitted
+)
+
+// header is the on-disk file header. Fields are fixed size so the layout can
+// be read with encoding/binary; new fields must only be added immediately
+// before MAC, and any incompatible change must bump formatVersion.
+type header struct {
+	Magic      [8]byte
+	Version    uint16
+	Cipher     uint16
+	PageSize   uint32
+	FileID     [fileIDSize]byte
+	KDF        keys.KDFParams
+	KeyCheck   [32]byte
+	Generation uint64
+	Flags      uint32
+	Root       [32]byte
+	Size       int64
+	Wrapped    [maxWrappedKeys]wrappedKey
+
+	NextWrapped   wrappedKey
+	NextKeyCheck  [32]byte
+	RekeyProgress int64
+
+	Ring [maxRingKeys]ringEntry
+
+	// Compression is nonzero for a compressed file, whose pages are found
+	// through the sealed page map in the MapLen bytes at unit MapUnit
+	Compression uint8
+	_           [7]byte
+	MapUnit     int64
+	MapLen      uint32
+	_           uint32
+	MapGen      uint64
+
+	MAC [32]byte
+}
+
+func newHeader(o *options) (*header, error) {
+	h := &header{
+		Magic:    magic,
+		Version:  formatVersion,
+		Cipher:   o.suite.ID(),
+		PageSize: uint32(o.pageSize),
+		KDF:      o.kdf,
+		Flags:    flagCommitted,
+
+		Compression: uint8(o.compression),
+	}
+	if o.rollbackProtection {
+		h.Flags |= flagMerkle
+	}
+	_, err := io.ReadFull(rand.Reader, h.FileID[:])
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// subkey derives an independent key for a single purpose from the file key
+func subkey(key [32]byte, label string, fileID [fileIDSize]byte) []byte {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(label))
+	mac.Write(fileID[:])
+	return mac.Sum(nil)
+}
+
+func (h *header) keyCheck(key [32]byte) [32]byte {
+	var rv [32]byte
+	copy(rv[:], subkey(key, "fresnel key check", h.FileID))
+	return rv
+}
+
+// mac authenticates every header field before the MAC itself
+func (h *header) mac(key [32]byte) [32]byte {
+	var rv [32]byte
+	b := h.encode()
+	mac := hmac.New(sha256.New, subkey(key, "fresnel header", h.FileID))
+	mac.Write(b[:len(b)-len(h.MAC)])
+	copy(rv[:], mac.Sum(nil))
+	return rv
+}
+
+// seal fills in the key check value and MAC for key
+func (h *header) seal(key [32]byte) {
+	h.KeyCheck = h.keyCheck(key)
+	h.MAC = h.mac(key)
+}
+
+// verify checks the header against key
+func (h *header) verify(key [32]byte) error {
+	check := h.keyCheck(key)
+	if !hmac.Equal(check[:], h.KeyCheck[:]) {
+		return ErrWrongKey
+	}
+	mac := h.mac(key)
+	if !hmac.Equal(mac[:], h.MAC[:]) {
+		return ErrCorruptHeader
+	}
+	return nil
+}
+
+func (h *header) encode() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, headerSize))
+	binary.Write(buf, binary.BigEndian, h)
+	return buf.Bytes()
+}
+
+// decodeHeader parses and sanity checks a header without verifying it
+func decodeHeader(b []byte) (*header, error) {
+	h := &header{}
+	err := binary.Read(bytes.NewReader(b), binary.BigEndian, h)
+	if err != nil {
+		return nil, err
+	}
+	if h.Magic != magic {
+		return nil, errNoHeader
+	}
+	if h.Version != formatVersion {
+		return nil, fmt.Errorf("unsupported format version %d", h.Version)
+	}
+	_, err = suite.ByID(h.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	if !validPageSize(int(h.PageSize)) {
+		return nil, fmt.Errorf("unsupported page size %d", h.PageSize)
+	}
+	if !validCompression(Compression(h.Compression)) {
+		return nil, fmt.Errorf("unsupported compression %d", h.Compression)
+	}
+	err = h.KDF.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// writeHeader seals the header as a new generation into the slot that does
+// not hold the current one
+func (f *EncryptedFile) writeHeader() error {
+	f.hdr.Generation++
+	f.hdr.seal(*f.key)
+	b := make([]byte, headerSlotSize)
+	copy(b, f.hdr.encode())
+	_, err := f.file.WriteAt(b, int64(f.hdr.Generation%2)*headerSlotSize)
+	return err
+}
+
+// readHeader returns the newest header slot that kek unlocks, along with the
+// data key. If neither does, a wrong key is reported in preference to
+// corruption.
+func (f *EncryptedFile) readHeader(kek [32]byte) (*header, [32]byte, error) {
+	var dek [32]byte
+	b := make([]byte, headerSize)
+	_, err := f.file.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return nil, dek, err
+	}
+	var best *header
+	var slotErr error
+	for slot := 0; slot < 2; slot++ {
+		h, err := decodeHeader(b[slot*headerSlotSize : (slot+1)*headerSlotSize])
+		if err != nil {
+			if slotErr == nil {
+				slotErr = err
+			}
+			continue
+		}
+		key, _, err := h.unwrapDataKey(kek)
+		if err == nil {
+			err = h.verify(key)
+		}
+		if err != nil {
+			if slotErr != ErrWrongKey {
+				slotErr = err
+			}
+			continue
+		}
+		if best == nil || h.Generation > best.Generation {
+			best = h
+			dek = key
+		}
+	}
+	if best == nil {
+		return nil, dek, slotErr
+	}
+	return best, dek, nil
+}
@@ -0,0 +1,275 @@
+package encryptedfile
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+)
+
+// A file whose pages are overwritten in place keeps a journal beside it.
+// Sealed pages that overwrite pages of the last header are appended to the
+// journal as one transaction, and only written over the file once the
+// journal is synced, when the file is next synced or the journal passes
+// maxJournalSize. So a crash cannot leave a mix of old and new pages or a
+// torn page: Open replays every complete transaction written since the
+// current header, and discards a transaction that was itself torn, in which
+// case the file was never touched. Each transaction also records the logical
+// size and Merkle root the file has once its pages are written, leaving out
+// pages past the last header, and replaying commits them in a new header.
+// Those pages are written straight to the file, since Open drops anything
+// past the size in the header. The journal is emptied once the file has been
+// synced. Compressed files never overwrite pages, so they need no journal.
+const journalSuffix = "-journal"
+
+// maxJournalSize is how large the journal grows before the file is synced
+// and the journal emptied
+const maxJournalSize = 4 << 20
+
+var journalMagic = [8]byte{'F', 'R', 'E', 'S', 'J', 'N', 'L', 0}
+
+// journalHeader starts each transaction. It is followed by Pages entries,
+// each a big-endian page ID and a sealed page, and then a MAC over the whole
+// transaction.
+type journalHeader struct {
+	Magic  [8]byte
+	FileID [fileIDSize]byte
+	// Generation is the header generation the transaction follows; older
+	// transactions are already durable in the file
+	Generation uint64
+	PageSize   uint32
+	Pages      uint32
+	// Size and Root are the file's logical size and Merkle root once the
+	// transaction's pages are written
+	Size uint64
+	Root [32]byte
+}
+
+const journalHeaderSize = 8 + fileIDSize + 8 + 4 + 4 + 8 + 32
+
+// journalTxn is a complete transaction read back from the journal
+type journalTxn struct {
+	h       journalHeader
+	entries []byte
+}
+
+type journal struct {
+	file  *os.File
+	size  int64            // bytes of transactions not yet known to be durable in the file
+	pages map[int64][]byte // sealed pages in the journal not yet written over the file
+}
+
+// openJournal opens the journal beside the file, with the file's own
+// permissions, replaying anything left in it by a crash
+func (f *EncryptedFile) openJournal(perm os.FileMode) error {
+	file, err := os.OpenFile(f.file.Name()+journalSuffix, os.O_CREATE|os.O_RDWR, perm)
+	if err != nil {
+		return err
+	}
+	f.journal = &journal{file: file, pages: make(map[int64][]byte)}
+	return f.recoverJournal()
+}
+
+// journalMAC authenticates a transaction under a subkey of the file key
+func (f *EncryptedFile) journalMAC(txn []byte) []byte {
+	mac := hmac.New(sha256.New, subkey(*f.key, "fresnel journal", f.hdr.FileID))
+	mac.Write(txn)
+	return mac.Sum(nil)
+}
+
+// committedPages is how many pages the last header covers
+func (f *EncryptedFile) committedPages() int64 {
+	return (f.syncedSize + f.dataPgSize - 1) / f.dataPgSize
+}
+
+// journalEntry encodes sealed pages as one transaction, along with the size
+// and root the file has once they are written, as far as the pages of the
+// last header
+func (f *EncryptedFile) journalEntry(ids []int64, sealed [][]byte) []byte {
+	var buf bytes.Buffer
+	committed := f.committedPages()
+	h := journalHeader{
+		Magic:      journalMagic,
+		FileID:     f.hdr.FileID,
+		Generation: f.hdr.Generation,
+		PageSize:   f.hdr.PageSize,
+		Pages:      uint32(len(ids)),
+		Size:       uint64(f.hdr.Size),
+	}
+	if limit := committed * f.dataPgSize; f.hdr.Size > limit {
+		h.Size = uint64(limit)
+	}
+	if f.tree != nil {
+		h.Root = f.tree.prefixRoot(committed)
+	}
+	binary.Write(&buf, binary.BigEndian, &h)
+	var id [8]byte
+	for i, pgID := range ids {
+		binary.BigEndian.PutUint64(id[:], uint64(pgID))
+		buf.Write(id[:])
+		buf.Write(sealed[i])
+	}
+	buf.Write(f.journalMAC(buf.Bytes()))
+	return buf.Bytes()
+}
+
+// append adds a transaction to the journal. It is only synced once its
+// pages are to be written over the file.
+func (j *journal) append(txn []byte) error {
+	_, err := j.file.WriteAt(txn, j.size)
+	if err != nil {
+		return err
+	}
+	j.size += int64(len(txn))
+	return nil
+}
+
+// applyJournal syncs the journal, then writes its pages over the file
+func (f *EncryptedFile) applyJournal() error {
+	if f.journal == nil || len(f.journal.pages) == 0 {
+		return nil
+	}
+	err := f.journal.file.Sync()
+	if err != nil {
+		return err
+	}
+	for pgID, sealed := range f.journal.pages {
+		_, err = f.file.WriteAt(sealed, headerSize+pgID*f.pgSize)
+		if err != nil {
+			return err
+		}
+		delete(f.journal.pages, pgID)
+	}
+	return nil
+}
+
+// clear empties the journal once the file holds everything in it
+func (j *journal) clear() error {
+	if j.size == 0 {
+		return nil
+	}
+	err := j.file.Truncate(0)
+	if err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	j.size = 0
+	return nil
+}
+
+// closeJournal closes the journal, removing it if it is empty
+func (f *EncryptedFile) closeJournal() error {
+	if f.journal == nil {
+		return nil
+	}
+	empty := f.journal.size == 0
+	err := f.journal.file.Close()
+	if err == nil && empty {
+		err = os.Remove(f.journal.file.Name())
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	return err
+}
+
+// checkpoint writes the journal's pages over the file, syncs it and empties
+// the journal
+func (f *EncryptedFile) checkpoint() error {
+	if f.journal == nil || f.journal.size == 0 {
+		return nil
+	}
+	err := f.applyJournal()
+	if err != nil {
+		return err
+	}
+	err = f.file.Sync()
+	if err != nil {
+		return err
+	}
+	return f.journal.clear()
+}
+
+// pendingTxns returns every complete transaction in b since the current
+// header, in order, stopping at the first that is torn or stale
+func (f *EncryptedFile) pendingTxns(b []byte) ([]journalTxn, error) {
+	var txns []journalTxn
+	for len(b) >= journalHeaderSize {
+		var h journalHeader
+		err := binary.Read(bytes.NewReader(b), binary.BigEndian, &h)
+		if err != nil {
+			return nil, err
+		}
+		if h.Magic != journalMagic || h.FileID != f.hdr.FileID ||
+			h.Generation != f.hdr.Generation || h.PageSize != f.hdr.PageSize {
+			break
+		}
+		size := journalHeaderSize + int64(h.Pages)*(8+int64(h.PageSize)) + sha256.Size
+		if int64(len(b)) < size {
+			break
+		}
+		txn, mac := b[:size-sha256.Size], b[size-sha256.Size:size]
+		if !hmac.Equal(mac, f.journalMAC(txn)) {
+			break
+		}
+		txns = append(txns, journalTxn{h: h, entries: txn[journalHeaderSize:]})
+		b = b[size:]
+	}
+	return txns, nil
+}
+
+// recoverJournal writes the pages of every complete transaction since the
+// current header over the file, in order, then commits the size and root of
+// the last one in a new header and empties the journal
+func (f *EncryptedFile) recoverJournal() error {
+	all, err := ioutil.ReadAll(f.journal.file)
+	if err != nil {
+		return err
+	}
+	txns, err := f.pendingTxns(all)
+	if err != nil {
+		return err
+	}
+	entrySize := 8 + f.pgSize
+	for _, txn := range txns {
+		for entry := txn.entries; len(entry) > 0; entry = entry[entrySize:] {
+			pgID := int64(binary.BigEndian.Uint64(entry))
+			_, err = f.file.WriteAt(entry[8:entrySize], headerSize+pgID*f.pgSize)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	f.journal.size = int64(len(all))
+	if len(txns) > 0 {
+		last := txns[len(txns)-1].h
+		f.hdr.Size = int64(last.Size)
+		f.hdr.Root = last.Root
+		return f.commitHeader()
+	}
+	return f.journal.clear()
+}
+
+// checkJournal returns ErrJournalPending if the journal beside a file opened
+// read-only holds writes that recoverJournal would replay
+func (f *EncryptedFile) checkJournal() error {
+	all, err := ioutil.ReadFile(f.file.Name() + journalSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	txns, err := f.pendingTxns(all)
+	if err != nil {
+		return err
+	}
+	if len(txns) > 0 {
+		return ErrJournalPending
+	}
+	return nil
+}
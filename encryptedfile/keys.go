@@ -0,0 +1,143 @@
+package encryptedfile
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"github.com/awans/fresnel/keys"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// maxWrappedKeys is how many key-encryption keys can unlock one file
+const maxWrappedKeys = 8
+
+// wrappedKey is the file's data key sealed under one key-encryption key
+type wrappedKey struct {
+	InUse  bool
+	Nonce  [nonceSize]byte
+	Sealed [32 + chacha20poly1305.Overhead]byte
+}
+
+func wrapKey(kek [32]byte, dek [32]byte, fileID [fileIDSize]byte) (wrappedKey, error) {
+	w := wrappedKey{InUse: true}
+	aead, err := chacha20poly1305.NewX(kek[:])
+	if err != nil {
+		return w, err
+	}
+	_, err = io.ReadFull(rand.Reader, w.Nonce[:])
+	if err != nil {
+		return w, err
+	}
+	aead.Seal(w.Sealed[:0], w.Nonce[:], dek[:], wrapAdditionalData(fileID))
+	return w, nil
+}
+
+func (w *wrappedKey) unwrap(kek [32]byte, fileID [fileIDSize]byte) ([32]byte, bool) {
+	var dek [32]byte
+	if !w.InUse {
+		return dek, false
+	}
+	aead, err := chacha20poly1305.NewX(kek[:])
+	if err != nil {
+		return dek, false
+	}
+	_, err = aead.Open(dek[:0], w.Nonce[:], w.Sealed[:], wrapAdditionalData(fileID))
+	return dek, err == nil
+}
+
+func wrapAdditionalData(fileID [fileIDSize]byte) []byte {
+	return append([]byte("fresnel data key"), fileID[:]...)
+}
+
+func newDataKey() ([32]byte, error) {
+	var dek [32]byte
+	_, err := io.ReadFull(rand.Reader, dek[:])
+	return dek, err
+}
+
+// unwrapDataKey returns the data key from the first slot kek unlocks
+func (h *header) unwrapDataKey(kek [32]byte) ([32]byte, int, error) {
+	for i := range h.Wrapped {
+		dek, ok := h.Wrapped[i].unwrap(kek, h.FileID)
+		if ok {
+			return dek, i, nil
+		}
+	}
+	return [32]byte{}, -1, ErrWrongKey
+}
+
+// AddKey lets kek open the file as well as the keys that already can. Each
+// key-encryption key only wraps the file's random data key, so adding or
+// removing one rewrites the header but no pages.
+func (f *EncryptedFile) AddKey(kek [32]byte) error {
+	return f.addKey(kek, nil)
+}
+
+// addKey adds kek, committing params as the file's key derivation parameters
+// in the same header if they are given. The header is left as it was if the
+// commit fails.
+func (f *EncryptedFile) addKey(kek [32]byte, params *keys.KDFParams) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if err := f.writable(); err != nil {
+		return err
+	}
+	if _, _, err := f.hdr.unwrapDataKey(kek); err == nil {
+		return nil
+	}
+	if params != nil && f.hdr.KDF.Algorithm != keys.KDFNone {
+		return errors.New("key derivation parameters were set concurrently")
+	}
+	for i := range f.hdr.Wrapped {
+		if f.hdr.Wrapped[i].InUse {
+			continue
+		}
+		w, err := wrapKey(kek, *f.key, f.hdr.FileID)
+		if err != nil {
+			return err
+		}
+		old, oldKDF := f.hdr.Wrapped[i], f.hdr.KDF
+		f.hdr.Wrapped[i] = w
+		if params != nil {
+			f.hdr.KDF = *params
+		}
+		err = f.commitHeader()
+		if err != nil {
+			f.hdr.Wrapped[i], f.hdr.KDF = old, oldKDF
+		}
+		return err
+	}
+	return errors.New("too many keys")
+}
+
+// RemoveKey stops kek from opening the file. The last key cannot be removed.
+// Rotating a master key is AddKey with the new key followed by RemoveKey with
+// the old one.
+func (f *EncryptedFile) RemoveKey(kek [32]byte) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if err := f.writable(); err != nil {
+		return err
+	}
+	_, slot, err := f.hdr.unwrapDataKey(kek)
+	if err != nil {
+		return err
+	}
+	inUse := 0
+	for i := range f.hdr.Wrapped {
+		if f.hdr.Wrapped[i].InUse {
+			inUse++
+		}
+	}
+	if inUse == 1 {
+		return errors.New("cannot remove the only key")
+	}
+	f.hdr.Wrapped[slot] = wrappedKey{}
+	// write both header slots so neither still holds the removed key
+	err = f.commitHeader()
+	if err != nil {
+		return err
+	}
+	return f.commitHeader()
+}
@@ -0,0 +1,103 @@
+package encryptedfile
+
+import (
+	"io"
+	"os"
+
+	"github.com/awans/fresnel/keys"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Files written before the header was added are a run of fixed-size pages,
+// each a random nonce followed by the page sealed with secretbox under the
+// key itself. Every page is full, so the logical size is a whole number of
+// pages.
+const legacyPgSize = 4096
+const legacyNonceSize = 24
+const legacyDataPgSize = legacyPgSize - legacyNonceSize - secretbox.Overhead
+
+// isLegacy reports whether file is a legacy file sealed with key, judged by
+// whether its first page opens
+func isLegacy(file *os.File, size int64, key [32]byte) bool {
+	if size == 0 || size%legacyPgSize != 0 {
+		return false
+	}
+	b := make([]byte, legacyPgSize)
+	_, err := file.ReadAt(b, 0)
+	if err != nil {
+		return false
+	}
+	data, ok := openLegacyPage(b, key)
+	keys.Wipe(data)
+	return ok
+}
+
+func openLegacyPage(b []byte, key [32]byte) ([]byte, bool) {
+	var nonce [legacyNonceSize]byte
+	copy(nonce[:], b[:legacyNonceSize])
+	return secretbox.Open(nil, b[legacyNonceSize:], &nonce, &key)
+}
+
+// MigrateLegacy rewrites the legacy file name, sealed with key, in the
+// current format with opts, after which Open opens it with key. The new file
+// is written beside the old one and renamed over it once synced, so a crash
+// leaves one or the other.
+func MigrateLegacy(name string, key [32]byte, opts ...Option) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if !isLegacy(in, fi.Size(), key) {
+		return errNoHeader
+	}
+
+	tmp := name + ".migrate"
+	out, err := Open(tmp, key, append(opts[:len(opts):len(opts)], Exclusive(), Mode(fi.Mode().Perm()))...)
+	if err != nil {
+		return err
+	}
+	err = copyLegacy(out, in, key)
+	if err == nil {
+		err = out.Sync()
+	}
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		os.Remove(tmp + journalSuffix)
+	}
+	return err
+}
+
+// copyLegacy opens each page of the legacy file in and writes it to out
+func copyLegacy(out *EncryptedFile, in *os.File, key [32]byte) error {
+	b := make([]byte, legacyPgSize)
+	for pgID := int64(0); ; pgID++ {
+		_, err := in.ReadAt(b, pgID*legacyPgSize)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data, ok := openLegacyPage(b, key)
+		if !ok {
+			return ErrCorruptPage{PageID: pgID}
+		}
+		_, err = out.WriteAt(data, pgID*legacyDataPgSize)
+		keys.Wipe(data)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package encryptedfile
+
+import "crypto/sha256"
+
+// merkleTree is a binary hash tree over the sealed pages of a file. Leaves
+// are hashes of each page exactly as stored on disk, so a page that is
+// validly encrypted but older than the one last written no longer matches.
+// An odd node at the end of a level is promoted unchanged to the next level.
+type merkleTree struct {
+	levels [][][32]byte
+}
+
+func newMerkleTree() *merkleTree {
+	return &merkleTree{levels: [][][32]byte{nil}}
+}
+
+func leafHash(sealed []byte) [32]byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(sealed)
+	var rv [32]byte
+	copy(rv[:], h.Sum(nil))
+	return rv
+}
+
+func nodeHash(left, right [32]byte) [32]byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left[:])
+	h.Write(right[:])
+	var rv [32]byte
+	copy(rv[:], h.Sum(nil))
+	return rv
+}
+
+func (t *merkleTree) numLeaves() int64 {
+	return int64(len(t.levels[0]))
+}
+
+func (t *merkleTree) leaf(pgID int64) [32]byte {
+	return t.levels[0][pgID]
+}
+
+// root returns the root hash, or all zeros for an empty tree
+func (t *merkleTree) root() [32]byte {
+	top := t.levels[len(t.levels)-1]
+	if len(top) == 0 {
+		return [32]byte{}
+	}
+	return top[0]
+}
+
+// prefixRoot returns the root the tree would have with only its first n
+// leaves. Every node but the last of each level is the same as in the whole
+// tree, so only the path from leaf n-1 is hashed again.
+func (t *merkleTree) prefixRoot(n int64) [32]byte {
+	if n >= t.numLeaves() {
+		return t.root()
+	}
+	if n == 0 {
+		return [32]byte{}
+	}
+	last := t.levels[0][n-1]
+	for lvl, count := 0, n; count > 1; lvl, count = lvl+1, (count+1)/2 {
+		if count%2 == 0 {
+			last = nodeHash(t.levels[lvl][count-2], last)
+		}
+	}
+	return last
+}
+
+func (t *merkleTree) node(lvl int, i int) [32]byte {
+	children := t.levels[lvl]
+	if 2*i+1 < len(children) {
+		return nodeHash(children[2*i], children[2*i+1])
+	}
+	return children[2*i]
+}
+
+// set updates the leaf for pgID and the path above it. Appending the next
+// leaf only touches that path; leaving a gap rebuilds the whole tree.
+func (t *merkleTree) set(pgID int64, h [32]byte) {
+	leaves := t.levels[0]
+	if pgID > int64(len(leaves)) {
+		for int64(len(leaves)) < pgID {
+			leaves = append(leaves, [32]byte{})
+		}
+		t.levels[0] = append(leaves, h)
+		t.rebuild()
+		return
+	}
+	if pgID == int64(len(leaves)) {
+		t.levels[0] = append(leaves, h)
+	} else {
+		leaves[pgID] = h
+	}
+
+	i := int(pgID)
+	lvl := 0
+	for ; len(t.levels[lvl]) > 1; lvl++ {
+		if lvl+1 == len(t.levels) {
+			t.levels = append(t.levels, nil)
+		}
+		parents := t.levels[lvl+1]
+		size := (len(t.levels[lvl]) + 1) / 2
+		for len(parents) < size {
+			parents = append(parents, [32]byte{})
+		}
+		i /= 2
+		parents[i] = t.node(lvl, i)
+		t.levels[lvl+1] = parents
+	}
+	t.levels = t.levels[:lvl+1]
+}
+
+// truncate drops every leaf at or after pgID
+func (t *merkleTree) truncate(pgID int64) {
+	if pgID >= t.numLeaves() {
+		return
+	}
+	t.levels[0] = t.levels[0][:pgID]
+	t.rebuild()
+}
+
+func (t *merkleTree) rebuild() {
+	t.levels = t.levels[:1]
+	for lvl := 0; len(t.levels[lvl]) > 1; lvl++ {
+		parents := make([][32]byte, (len(t.levels[lvl])+1)/2)
+		for i := range parents {
+			parents[i] = t.node(lvl, i)
+		}
+		t.levels = append(t.levels, parents)
+	}
+}
+
+// buildMerkleTree hashes every page on disk
+func (f *EncryptedFile) buildMerkleTree() (*merkleTree, error) {
+	t := newMerkleTree()
+	for pgID := int64(0); pgID < f.numPg; pgID++ {
+		sealed, err := f.readSealed(pgID, pgID)
+		if err != nil {
+			return nil, err
+		}
+		t.levels[0] = append(t.levels[0], leafHash(sealed[0]))
+	}
+	t.rebuild()
+	return t, nil
+}
+
+// Root returns the Merkle root over every page as of the last Sync, for
+// pinning outside the file with the RollbackProtection option. It is all
+// zeros unless the file was created with RollbackProtection.
+func (f *EncryptedFile) Root() [32]byte {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	return f.hdr.Root
+}
@@ -0,0 +1,245 @@
+package encryptedfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/awans/fresnel/keys"
+	"github.com/awans/fresnel/suite"
+)
+
+// Page size limits
+const (
+	DefaultPageSize = 4096
+	MinPageSize     = 1024
+	MaxPageSize     = 1 << 20
+)
+
+// Option configures an EncryptedFile when it is opened
+type Option func(*options)
+
+type options struct {
+	pageSize  int
+	cacheSize int64
+	writeBack int64
+	workers   int
+
+	rollbackProtection bool
+	pinnedRoot         *[32]byte
+	resumeRekey        *[32]byte
+	kdf                keys.KDFParams
+	suite              suite.Suite
+	compression        Compression
+	append             bool
+	readOnly           bool
+	mustExist          bool
+	exclusive          bool
+	mode               os.FileMode
+	verifyOnly         bool
+}
+
+// PageSize sets the size of each encrypted page, including the nonce and
+// authentication tag, for a newly created file. It must be a power of two
+// between MinPageSize and MaxPageSize. Existing files are always read with the
+// page size recorded in their header.
+func PageSize(size int) Option {
+	return func(o *options) {
+		o.pageSize = size
+	}
+}
+
+// CacheSize sets the memory budget in bytes for decrypted pages. A size of
+// zero disables the cache.
+func CacheSize(size int64) Option {
+	return func(o *options) {
+		o.cacheSize = size
+	}
+}
+
+// WriteBack buffers up to size bytes of modified pages in memory and seals
+// each page once, at Sync or Close or when the buffer fills, rather than on
+// every WriteAt. A size of zero, the default, writes through.
+func WriteBack(size int64) Option {
+	return func(o *options) {
+		o.writeBack = size
+	}
+}
+
+// Workers sets how many goroutines seal or open the pages of a single
+// multi-page read or write. It defaults to the number of CPUs.
+func Workers(n int) Option {
+	return func(o *options) {
+		o.workers = n
+	}
+}
+
+// RollbackProtection maintains a Merkle tree over every page of a newly
+// created file, with its root in the authenticated header. Open then rejects
+// files whose pages were replaced by older, validly encrypted copies, and
+// ReadAt rejects pages replaced while the file is open. Opening an existing
+// file hashes every page, and pages written since the last Sync are treated
+// as rolled back.
+func RollbackProtection() Option {
+	return func(o *options) {
+		o.rollbackProtection = true
+	}
+}
+
+// PinRoot requires the Merkle root of the file to equal root, as returned by
+// Root after the last Sync. This detects a whole file, header included,
+// being restored from an older snapshot.
+func PinRoot(root [32]byte) Option {
+	return func(o *options) {
+		o.pinnedRoot = &root
+	}
+}
+
+// ResumeRekey opens a file whose key rotation was interrupted, using the key
+// passed to Open for pages not yet rotated and newKey for the rest. Call
+// Rekey with newKey to finish the rotation.
+func ResumeRekey(newKey [32]byte) Option {
+	return func(o *options) {
+		o.resumeRekey = &newKey
+	}
+}
+
+// KDF sets how OpenPassphrase derives the key of a newly created file from
+// its passphrase. A zero salt is replaced with a random one. It defaults to
+// Argon2id with the costs from keys.NewKDFParams.
+func KDF(params keys.KDFParams) Option {
+	return func(o *options) {
+		o.kdf = params
+	}
+}
+
+// Cipher sets the cipher suite the pages of a newly created file are sealed
+// with. It defaults to suite.Default. Existing files are always read with the
+// suite recorded in their header.
+func Cipher(s suite.Suite) Option {
+	return func(o *options) {
+		o.suite = s
+	}
+}
+
+// Compress compresses each page of a newly created file before sealing it.
+// Compressed pages are stored in as many eighths of a page as they need, and
+// a sealed page map in the header records where each one is. Existing files
+// are always read with the compression recorded in their header.
+func Compress(c Compression) Option {
+	return func(o *options) {
+		o.compression = c
+	}
+}
+
+// Append makes every Write add to the end of the file, like os.O_APPEND.
+// ReadAt, WriteAt and Seek are unaffected.
+func Append() Option {
+	return func(o *options) {
+		o.append = true
+	}
+}
+
+// ReadOnly opens an existing file without write access, so it can be read on
+// a read-only mount and cannot be modified through the EncryptedFile: writes,
+// Truncate and key changes return ErrReadOnly. A journal left by a crash
+// cannot be replayed read-only, so Open returns ErrJournalPending until the
+// file is opened for writing once.
+func ReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+// MustExist makes Open fail rather than create a file that does not exist
+func MustExist() Option {
+	return func(o *options) {
+		o.mustExist = true
+	}
+}
+
+// Exclusive makes Open fail if the file already exists, like os.O_EXCL
+func Exclusive() Option {
+	return func(o *options) {
+		o.exclusive = true
+	}
+}
+
+// Mode sets the permissions a newly created file and its journal are given,
+// before the umask. It defaults to 0600.
+func Mode(perm os.FileMode) Option {
+	return func(o *options) {
+		o.mode = perm
+	}
+}
+
+// VerifyOnly opens a file read-only for Verify even if its pages do not hash
+// to the Merkle root in its header or to the pinned root, which Open otherwise
+// rejects with ErrRollback. Verify then reports each page that fails to open,
+// and sets RolledBack in its report.
+func VerifyOnly() Option {
+	return func(o *options) {
+		o.verifyOnly = true
+		o.readOnly = true
+	}
+}
+
+// flag returns the os.OpenFile flags the options ask for
+func (o *options) flag() int {
+	switch {
+	case o.readOnly:
+		return os.O_RDONLY
+	case o.exclusive:
+		return os.O_RDWR | os.O_CREATE | os.O_EXCL
+	case o.mustExist:
+		return os.O_RDWR
+	}
+	return os.O_RDWR | os.O_CREATE
+}
+
+func newOptions(opts []Option) (*options, error) {
+	o := &options{
+		pageSize:  DefaultPageSize,
+		cacheSize: DefaultCacheSize,
+		workers:   runtime.NumCPU(),
+		suite:     suite.Default,
+		mode:      0600,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if !validPageSize(o.pageSize) {
+		return nil, fmt.Errorf("invalid page size %d", o.pageSize)
+	}
+	if o.cacheSize < 0 {
+		return nil, fmt.Errorf("invalid cache size %d", o.cacheSize)
+	}
+	if o.writeBack < 0 {
+		return nil, fmt.Errorf("invalid write-back buffer size %d", o.writeBack)
+	}
+	if o.suite == nil {
+		return nil, fmt.Errorf("no cipher suite")
+	}
+	if !validCompression(o.compression) {
+		return nil, fmt.Errorf("unknown compression %d", o.compression)
+	}
+	if o.workers < 1 {
+		return nil, fmt.Errorf("invalid number of workers %d", o.workers)
+	}
+	if o.exclusive && (o.readOnly || o.mustExist) {
+		return nil, errors.New("an exclusive open must create the file")
+	}
+	if o.mode&^os.ModePerm != 0 {
+		return nil, fmt.Errorf("invalid file mode %v", o.mode)
+	}
+	err := o.kdf.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func validPageSize(size int) bool {
+	return size >= MinPageSize && size <= MaxPageSize && size&(size-1) == 0
+}
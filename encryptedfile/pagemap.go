@@ -0,0 +1,298 @@
+package encryptedfile
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/awans/fresnel/keys"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// A compressed file divides the space after its header into units of an
+// eighth of a page. Each sealed page takes as many whole units as it needs,
+// and the page map records which units hold each page. Pages are never
+// rewritten in place: a modified page goes to free units, and the units it
+// used are only reused once a header describing the new map is durable.
+const unitsPerPage = 8
+
+// extent is a run of n units starting at unit
+type extent struct {
+	unit int64
+	n    int64
+}
+
+type pageMap struct {
+	unitSize int64
+	pages    []extent // by page ID
+	units    int64    // units in the file
+	free     []extent // sorted by unit
+	pending  []extent // released since the last header commit
+	dirty    bool     // pages differ from the map in the header
+}
+
+func newPageMap(pgSize int64) *pageMap {
+	return &pageMap{unitSize: pgSize / unitsPerPage}
+}
+
+// unitsFor returns how many units hold size bytes
+func (m *pageMap) unitsFor(size int64) int64 {
+	return (size + m.unitSize - 1) / m.unitSize
+}
+
+func (m *pageMap) offset(unit int64) int64 {
+	return headerSize + unit*m.unitSize
+}
+
+// alloc returns n free units, from the first free run big enough or else
+// from the end of the file
+func (m *pageMap) alloc(n int64) extent {
+	for i, e := range m.free {
+		if e.n < n {
+			continue
+		}
+		rv := extent{e.unit, n}
+		if e.n == n {
+			m.free = append(m.free[:i], m.free[i+1:]...)
+		} else {
+			m.free[i] = extent{e.unit + n, e.n - n}
+		}
+		return rv
+	}
+	rv := extent{m.units, n}
+	m.units += n
+	return rv
+}
+
+// release frees e once the next header is committed
+func (m *pageMap) release(e extent) {
+	if e.n > 0 {
+		m.pending = append(m.pending, e)
+	}
+}
+
+// set records that pgID is stored in e, releasing its old units
+func (m *pageMap) set(pgID int64, e extent) {
+	for int64(len(m.pages)) <= pgID {
+		m.pages = append(m.pages, extent{})
+	}
+	m.release(m.pages[pgID])
+	m.pages[pgID] = e
+	m.dirty = true
+}
+
+// truncate drops every page at or after pgID
+func (m *pageMap) truncate(pgID int64) {
+	if pgID >= int64(len(m.pages)) {
+		return
+	}
+	for _, e := range m.pages[pgID:] {
+		m.release(e)
+	}
+	m.pages = m.pages[:pgID]
+	m.dirty = true
+}
+
+// committed makes units released before a header commit reusable
+func (m *pageMap) committed() {
+	if len(m.pending) == 0 {
+		return
+	}
+	m.setFree(append(m.free, m.pending...))
+	m.pending = nil
+}
+
+// setFree replaces the free list, merging adjacent runs
+func (m *pageMap) setFree(free []extent) {
+	sort.Slice(free, func(i, j int) bool { return free[i].unit < free[j].unit })
+	m.free = m.free[:0]
+	for _, e := range free {
+		if last := len(m.free) - 1; last >= 0 && m.free[last].unit+m.free[last].n == e.unit {
+			m.free[last].n += e.n
+			continue
+		}
+		m.free = append(m.free, e)
+	}
+}
+
+// findFree rebuilds the free list from the units no page or the map itself
+// uses
+func (m *pageMap) findFree(mapExtent extent) {
+	used := make([]bool, m.units)
+	for _, e := range append(m.pages, mapExtent) {
+		for u := e.unit; u < e.unit+e.n && u < m.units; u++ {
+			used[u] = true
+		}
+	}
+	var free []extent
+	for u := int64(0); u < m.units; u++ {
+		if !used[u] {
+			free = append(free, extent{u, 1})
+		}
+	}
+	m.setFree(free)
+}
+
+const mapEntrySize = 9
+
+func (m *pageMap) encode() []byte {
+	b := make([]byte, len(m.pages)*mapEntrySize)
+	for i, e := range m.pages {
+		binary.BigEndian.PutUint64(b[i*mapEntrySize:], uint64(e.unit))
+		b[i*mapEntrySize+8] = byte(e.n)
+	}
+	return b
+}
+
+func (m *pageMap) decode(b []byte) error {
+	if len(b)%mapEntrySize != 0 {
+		return ErrCorruptHeader
+	}
+	m.pages = make([]extent, len(b)/mapEntrySize)
+	for i := range m.pages {
+		e := extent{int64(binary.BigEndian.Uint64(b[i*mapEntrySize:])), int64(b[i*mapEntrySize+8])}
+		if e.n < 1 || e.n > unitsPerPage || e.unit < 0 || e.unit+e.n > m.units {
+			return ErrCorruptHeader
+		}
+		m.pages[i] = e
+	}
+	return nil
+}
+
+// mapAEAD seals the page map under a subkey of the file key
+func (f *EncryptedFile) mapAEAD() (cipher.AEAD, error) {
+	key := subkey(*f.key, "fresnel page map", f.hdr.FileID)
+	defer keys.Wipe(key)
+	return chacha20poly1305.NewX(key)
+}
+
+func mapAdditionalData(fileID [fileIDSize]byte, gen uint64) []byte {
+	ad := make([]byte, fileIDSize+8)
+	copy(ad, fileID[:])
+	binary.BigEndian.PutUint64(ad[fileIDSize:], gen)
+	return ad
+}
+
+// writeMap seals the page map into free units and points the header at it,
+// if it has changed. The map is bound to the generation of the header about
+// to be written, so an older map cannot be swapped in.
+func (f *EncryptedFile) writeMap() error {
+	if !f.pmap.dirty {
+		return nil
+	}
+	aead, err := f.mapAEAD()
+	if err != nil {
+		return err
+	}
+	gen := f.hdr.Generation + 1
+	plain := f.pmap.encode()
+	sealed := make([]byte, nonceSize, nonceSize+len(plain)+aead.Overhead())
+	_, err = io.ReadFull(rand.Reader, sealed)
+	if err != nil {
+		return err
+	}
+	sealed = aead.Seal(sealed, sealed[:nonceSize], plain, mapAdditionalData(f.hdr.FileID, gen))
+
+	e := f.pmap.alloc(f.pmap.unitsFor(int64(len(sealed))))
+	_, err = f.file.WriteAt(sealed, f.pmap.offset(e.unit))
+	if err != nil {
+		f.pmap.release(e)
+		return err
+	}
+	f.pmap.release(f.mapExtent())
+	f.hdr.MapUnit, f.hdr.MapLen, f.hdr.MapGen = e.unit, uint32(len(sealed)), gen
+	f.pmap.dirty = false
+	return nil
+}
+
+// mapExtent returns the units holding the map the header points at
+func (f *EncryptedFile) mapExtent() extent {
+	if f.hdr.MapLen == 0 {
+		return extent{}
+	}
+	return extent{f.hdr.MapUnit, f.pmap.unitsFor(int64(f.hdr.MapLen))}
+}
+
+// readMap loads the page map the header points at
+func (f *EncryptedFile) readMap(fileSize int64) error {
+	f.pmap = newPageMap(f.pgSize)
+	if fileSize > headerSize {
+		f.pmap.units = f.pmap.unitsFor(fileSize - headerSize)
+	}
+	if f.hdr.MapLen > 0 {
+		e := f.mapExtent()
+		if e.unit < 0 || e.unit+e.n > f.pmap.units {
+			return ErrCorruptHeader
+		}
+		sealed := make([]byte, f.hdr.MapLen)
+		_, err := f.file.ReadAt(sealed, f.pmap.offset(e.unit))
+		if err != nil {
+			return err
+		}
+		aead, err := f.mapAEAD()
+		if err != nil {
+			return err
+		}
+		if len(sealed) < nonceSize {
+			return ErrCorruptHeader
+		}
+		plain, err := aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:],
+			mapAdditionalData(f.hdr.FileID, f.hdr.MapGen))
+		if err != nil {
+			return ErrCorruptHeader
+		}
+		err = f.pmap.decode(plain)
+		if err != nil {
+			return err
+		}
+	}
+	f.pmap.findFree(f.mapExtent())
+	return nil
+}
+
+// writeMapped writes sealed pages, each to free units
+func (f *EncryptedFile) writeMapped(start int64, sealed [][]byte) error {
+	extents := make([]extent, len(sealed))
+	for i, s := range sealed {
+		extents[i] = f.pmap.alloc(f.pmap.unitsFor(int64(len(s))))
+	}
+	// coalesce pages that landed in adjacent units into one write
+	for i := 0; i < len(sealed); {
+		j := i + 1
+		buf := sealed[i]
+		for j < len(sealed) && extents[j].unit == extents[j-1].unit+extents[j-1].n {
+			buf = append(buf[:len(buf):len(buf)], sealed[j]...)
+			j++
+		}
+		_, err := f.file.WriteAt(buf, f.pmap.offset(extents[i].unit))
+		if err != nil {
+			for _, e := range extents[i:] {
+				f.pmap.release(e)
+			}
+			return err
+		}
+		for k := i; k < j; k++ {
+			f.pmap.set(start+int64(k), extents[k])
+		}
+		i = j
+	}
+	return nil
+}
+
+// readMapped reads the sealed pages from start to end inclusive, with nil
+// for pages the file does not hold
+func (f *EncryptedFile) readMapped(start int64, end int64) ([][]byte, error) {
+	sealed := make([][]byte, end-start+1)
+	for pgID := start; pgID <= end && pgID < int64(len(f.pmap.pages)); pgID++ {
+		e := f.pmap.pages[pgID]
+		b := make([]byte, e.n*f.pmap.unitSize)
+		_, err := f.file.ReadAt(b, f.pmap.offset(e.unit))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		sealed[pgID-start] = b
+	}
+	return sealed, nil
+}
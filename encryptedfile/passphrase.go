@@ -0,0 +1,180 @@
+package encryptedfile
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/awans/fresnel/keys"
+)
+
+// ErrNoPassphrase is returned by OpenPassphrase for a file that was created
+// with a raw key and never given a passphrase
+var ErrNoPassphrase = keys.ErrNoPassphrase
+
+// OpenProvider opens or creates an encrypted file with the key-encryption key
+// from p. If p derives its key from a passphrase, a new file records the key
+// derivation parameters from the KDF option, so only the passphrase is
+// needed to open it again. RefreshKey asks p for the key again.
+func OpenProvider(name string, p keys.KeyProvider, opts ...Option) (*EncryptedFile, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if o.readOnly || o.mustExist {
+		// fail before asking for a key for a file that is not there
+		if _, err := os.Stat(name); err != nil {
+			return nil, err
+		}
+	}
+	params, err := readKDFParams(name)
+	if err != nil {
+		return nil, err
+	}
+	var kek [32]byte
+	if params == nil {
+		var fresh keys.KDFParams
+		kek, fresh, err = keys.NewKey(p, o.kdf)
+		params = &fresh
+	} else {
+		kek, err = p.Key(*params)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f, err := Open(name, kek, append(opts[:len(opts):len(opts)], KDF(*params))...)
+	if err != nil {
+		return nil, err
+	}
+	f.provider = p
+	return f, nil
+}
+
+// OpenPassphrase opens or creates an encrypted file whose key-encryption key
+// is derived from passphrase. The salt and costs are recorded in the header
+// of a new file, so only the passphrase is needed to open it again.
+func OpenPassphrase(name string, passphrase []byte, opts ...Option) (*EncryptedFile, error) {
+	return OpenProvider(name, keys.Passphrase(passphrase), opts...)
+}
+
+// RefreshKey asks the key provider the file was opened with for its key
+// again. If the key has changed, the data key is wrapped under the new key
+// and unwrapped from the old one, so the provider can rotate keys while the
+// file is open.
+func (f *EncryptedFile) RefreshKey() error {
+	f.m.RLock()
+	p, params, old := f.provider, f.hdr.KDF, *f.kek
+	f.m.RUnlock()
+	if p == nil {
+		return errors.New("file was not opened with a key provider")
+	}
+	kek, err := p.Key(params)
+	if err != nil {
+		return err
+	}
+	if kek == old {
+		return nil
+	}
+	err = f.AddKey(kek)
+	if err != nil {
+		return err
+	}
+	err = f.RemoveKey(old)
+	if err != nil && err != ErrWrongKey {
+		return err
+	}
+	f.m.Lock()
+	*f.kek = kek
+	f.m.Unlock()
+	return nil
+}
+
+// AddPassphrase lets passphrase open the file with OpenPassphrase, as well as
+// the keys that already can. A file created with a raw key is given new
+// Argon2id parameters first.
+func (f *EncryptedFile) AddPassphrase(passphrase []byte) error {
+	kek, params, err := f.passphraseKey(passphrase)
+	if err != nil {
+		return err
+	}
+	return f.addKey(kek, params)
+}
+
+// RemovePassphrase stops passphrase from opening the file
+func (f *EncryptedFile) RemovePassphrase(passphrase []byte) error {
+	f.m.RLock()
+	params := f.hdr.KDF
+	f.m.RUnlock()
+	kek, err := keys.Passphrase(passphrase).Key(params)
+	if err != nil {
+		return err
+	}
+	return f.RemoveKey(kek)
+}
+
+// passphraseKey derives the key-encryption key for passphrase. For a file
+// created with a raw key it also returns new Argon2id parameters, which
+// addKey commits along with the key.
+func (f *EncryptedFile) passphraseKey(passphrase []byte) ([32]byte, *keys.KDFParams, error) {
+	f.m.RLock()
+	err := f.writable()
+	params := f.hdr.KDF
+	f.m.RUnlock()
+	if err != nil {
+		return [32]byte{}, nil, err
+	}
+	var fresh *keys.KDFParams
+	if params.Algorithm == keys.KDFNone {
+		params, err = keys.NewKDFParams(keys.KDFArgon2id)
+		if err != nil {
+			return [32]byte{}, nil, err
+		}
+		fresh = &params
+	}
+	kek, err := keys.DeriveKey(passphrase, params)
+	return kek, fresh, err
+}
+
+// readKDFParams returns the key derivation parameters from the newest header
+// slot of an existing file, or nil if there is no file yet. The parameters
+// are not authenticated here; tampering with them derives the wrong key,
+// which Open rejects.
+func readKDFParams(name string) (*keys.KDFParams, error) {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	b := make([]byte, headerSize)
+	n, err := file.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	var best *header
+	var slotErr error
+	for slot := 0; slot < 2; slot++ {
+		h, err := decodeHeader(b[slot*headerSlotSize : (slot+1)*headerSlotSize])
+		if err != nil {
+			slotErr = err
+			continue
+		}
+		if best == nil || h.Generation > best.Generation {
+			best = h
+		}
+	}
+	if best == nil && slotErr == errNoHeader {
+		// a legacy file has no header and was sealed with the raw key,
+		// which Open checks for
+		return &keys.KDFParams{}, nil
+	}
+	if best == nil {
+		return nil, slotErr
+	}
+	return &best.KDF, nil
+}
@@ -0,0 +1,128 @@
+package encryptedfile
+
+import "errors"
+
+// rekeyBatch is how many pages are re-encrypted between progress updates
+const rekeyBatch = 256
+
+// ErrRekeyInProgress is returned by Open when a previous Rekey did not
+// finish. Open the file with the old key and the ResumeRekey option, then
+// call Rekey again with the new key.
+var ErrRekeyInProgress = errors.New("key rotation in progress")
+
+// Rekey re-encrypts every page under a fresh data key, and replaces the file
+// key with a fresh one wrapped under newKey, for when the file key itself may
+// be compromised. Rotating only the key-encryption key is cheaper with AddKey
+// and RemoveKey, and rotating only the data key with RotateDataKey and
+// RetireDataKeys. Any other key-encryption keys are dropped and must be added
+// again.
+//
+// Pages are rotated in batches, releasing the file between them so reads and
+// writes can continue. Progress is recorded in the header after each batch,
+// so if the process dies the rotation can be resumed, and every page stays
+// readable with the data key it names.
+func (f *EncryptedFile) Rekey(newKey [32]byte) error {
+	err := f.startRekey(newKey)
+	if err != nil {
+		return err
+	}
+	for {
+		done, err := f.rekeyStep()
+		if err != nil {
+			return err
+		}
+		if done {
+			f.m.Lock()
+			*f.kek = newKey
+			f.m.Unlock()
+			return nil
+		}
+	}
+}
+
+func (f *EncryptedFile) startRekey(newKey [32]byte) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if err := f.writable(); err != nil {
+		return err
+	}
+	if f.hdr.Flags&flagRekey != 0 {
+		if _, ok := f.hdr.NextWrapped.unwrap(newKey, f.hdr.FileID); !ok {
+			return errors.New("a rotation to a different key is in progress")
+		}
+		return nil
+	}
+	nextKey, err := newDataKey()
+	if err != nil {
+		return err
+	}
+	nextWrapped, err := wrapKey(newKey, nextKey, f.hdr.FileID)
+	if err != nil {
+		return err
+	}
+	err = f.flush()
+	if err != nil {
+		return err
+	}
+	err = f.newRingKey()
+	if err != nil {
+		return err
+	}
+	*f.nextKey = nextKey
+	f.hdr.Flags |= flagRekey
+	f.hdr.NextWrapped = nextWrapped
+	f.hdr.NextKeyCheck = f.hdr.keyCheck(nextKey)
+	f.hdr.RekeyProgress = 0
+	return f.commitHeader()
+}
+
+// rekeyStep re-encrypts the next batch of pages and records the progress
+func (f *EncryptedFile) rekeyStep() (bool, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	start := f.hdr.RekeyProgress
+	if start >= f.numPg {
+		return true, f.finishRekey()
+	}
+	end := start + rekeyBatch - 1
+	if end >= f.numPg {
+		end = f.numPg - 1
+	}
+	pages, err := f.loadPages(start, end)
+	if err != nil {
+		return false, err
+	}
+	f.hdr.RekeyProgress = end + 1
+	err = f.writePages(pages)
+	if err != nil {
+		f.hdr.RekeyProgress = start
+		return false, err
+	}
+	return false, f.commitHeader()
+}
+
+// finishRekey switches the file over to the new file key, keeping only the
+// newest data key. The header is written to both slots so that neither still
+// accepts the old key.
+func (f *EncryptedFile) finishRekey() error {
+	err := f.resealRing(*f.nextKey, f.keyID)
+	if err != nil {
+		return err
+	}
+	*f.key = *f.nextKey
+	*f.nextKey = [32]byte{}
+	f.hdr.Flags &^= flagRekey
+	f.hdr.Wrapped = [maxWrappedKeys]wrappedKey{f.hdr.NextWrapped}
+	f.hdr.NextWrapped = wrappedKey{}
+	f.hdr.NextKeyCheck = [32]byte{}
+	f.hdr.RekeyProgress = 0
+	if f.pmap != nil {
+		// reseal the page map under the new file key
+		f.pmap.dirty = true
+	}
+	err = f.commitHeader()
+	if err != nil {
+		return err
+	}
+	return f.commitHeader()
+}
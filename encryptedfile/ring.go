@@ -0,0 +1,297 @@
+package encryptedfile
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/awans/fresnel/keys"
+	"github.com/awans/fresnel/suite"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// maxRingKeys is how many data keys a file can hold at once
+const maxRingKeys = 8
+
+// keyIDSize is the size of the key ID at the start of every sealed page
+const keyIDSize = 4
+
+// ringEntry is one data key of the key ring, sealed under a subkey of the
+// file key. Pages name the data key they are sealed with by its ID, so new
+// pages can be sealed with the newest key while older pages stay readable
+// until they are rewritten.
+type ringEntry struct {
+	ID     uint32 // zero for an unused entry
+	Nonce  [nonceSize]byte
+	Sealed [32 + chacha20poly1305.Overhead]byte
+}
+
+func ringAEAD(fileKey [32]byte, fileID [fileIDSize]byte) (cipher.AEAD, error) {
+	return chacha20poly1305.NewX(subkey(fileKey, "fresnel key ring", fileID))
+}
+
+func ringAdditionalData(fileID [fileIDSize]byte, id uint32) []byte {
+	ad := make([]byte, fileIDSize+keyIDSize)
+	copy(ad, fileID[:])
+	binary.BigEndian.PutUint32(ad[fileIDSize:], id)
+	return ad
+}
+
+// loadRing unseals the data keys in the header. The newest one is used for
+// writing.
+func (f *EncryptedFile) loadRing() error {
+	aead, err := ringAEAD(*f.key, f.hdr.FileID)
+	if err != nil {
+		return err
+	}
+	f.ringKeys = make(map[uint32]*[32]byte)
+	f.keyID = 0
+	for slot, e := range f.hdr.Ring {
+		if e.ID == 0 {
+			continue
+		}
+		key := f.mem.Key(3 + slot)
+		_, err = aead.Open(key[:0], e.Nonce[:], e.Sealed[:], ringAdditionalData(f.hdr.FileID, e.ID))
+		if err != nil {
+			return ErrCorruptHeader
+		}
+		f.addToRing(e.ID, key)
+	}
+	if f.keyID == 0 {
+		return ErrCorruptHeader
+	}
+	return nil
+}
+
+// addToRing makes a data key usable. key points into the file's locked
+// memory, at the slot matching its ring entry.
+func (f *EncryptedFile) addToRing(id uint32, key *[32]byte) {
+	f.ringKeys[id] = key
+	if id > f.keyID {
+		f.keyID = id
+	}
+}
+
+// dataCipher returns the AEAD for a data key. Data keys are only kept in
+// locked memory, and the AEAD is built for each use instead of being held,
+// since cipher.AEAD gives no way to wipe the key it expands.
+func (f *EncryptedFile) dataCipher(key *[32]byte) (cipher.AEAD, error) {
+	return f.suite.New(key[:])
+}
+
+// newRingKey adds a random data key to the ring, which new pages are then
+// sealed with. The header is not committed.
+func (f *EncryptedFile) newRingKey() error {
+	slot := -1
+	for i, e := range f.hdr.Ring {
+		if e.ID == 0 {
+			slot = i
+			break
+		}
+	}
+	if slot < 0 {
+		return errors.New("key ring is full; retire old data keys first")
+	}
+	key := f.mem.Key(3 + slot)
+	_, err := io.ReadFull(rand.Reader, key[:])
+	if err != nil {
+		return err
+	}
+	id := f.keyID + 1
+	e, err := sealRingKey(*f.key, f.hdr.FileID, id, *key)
+	if err != nil {
+		return err
+	}
+	f.addToRing(id, key)
+	f.hdr.Ring[slot] = e
+	return nil
+}
+
+func sealRingKey(fileKey [32]byte, fileID [fileIDSize]byte, id uint32, key [32]byte) (ringEntry, error) {
+	e := ringEntry{ID: id}
+	aead, err := ringAEAD(fileKey, fileID)
+	if err != nil {
+		return e, err
+	}
+	_, err = io.ReadFull(rand.Reader, e.Nonce[:])
+	if err != nil {
+		return e, err
+	}
+	aead.Seal(e.Sealed[:0], e.Nonce[:], key[:], ringAdditionalData(fileID, id))
+	return e, nil
+}
+
+// resealRing replaces the ring with the data keys from before onwards,
+// sealed under fileKey, wiping the keys it drops. Keys keep their slots. The
+// header is not committed.
+func (f *EncryptedFile) resealRing(fileKey [32]byte, before uint32) error {
+	var ring [maxRingKeys]ringEntry
+	for slot, e := range f.hdr.Ring {
+		if e.ID == 0 || e.ID < before {
+			continue
+		}
+		sealed, err := sealRingKey(fileKey, f.hdr.FileID, e.ID, *f.ringKeys[e.ID])
+		if err != nil {
+			return err
+		}
+		ring[slot] = sealed
+	}
+	for slot, e := range f.hdr.Ring {
+		if e.ID == 0 || e.ID >= before {
+			continue
+		}
+		keys.Wipe(f.mem.Key(3 + slot)[:])
+		delete(f.ringKeys, e.ID)
+	}
+	f.hdr.Ring = ring
+	return nil
+}
+
+// RotateDataKey adds a fresh data key to the ring. Pages written from now on
+// are sealed with it, while pages sealed with older keys stay readable until
+// RetireDataKeys rewrites them, so rotation needs no stop-the-world rewrite.
+func (f *EncryptedFile) RotateDataKey() error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if err := f.writable(); err != nil {
+		return err
+	}
+	if f.hdr.Flags&flagRekey != 0 {
+		return ErrRekeyInProgress
+	}
+	err := f.newRingKey()
+	if err != nil {
+		return err
+	}
+	return f.commitHeader()
+}
+
+// RetireDataKeys rewrites every page sealed with an older data key than the
+// newest, then removes the older keys from the ring. Pages are rewritten in
+// batches, releasing the file between them so reads and writes can continue.
+func (f *EncryptedFile) RetireDataKeys() error {
+	f.m.Lock()
+	target := f.keyID
+	err := f.writable()
+	if err == nil {
+		err = f.flush()
+	}
+	f.m.Unlock()
+	if err != nil {
+		return err
+	}
+	for start := int64(0); ; start += rekeyBatch {
+		done, err := f.retireStep(start, target)
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+	err = f.resealRing(*f.key, target)
+	if err != nil {
+		return err
+	}
+	// write both header slots so neither still holds a retired key
+	err = f.commitHeader()
+	if err != nil {
+		return err
+	}
+	return f.commitHeader()
+}
+
+// retireStep rewrites the pages of one batch sealed with a key older than
+// target
+func (f *EncryptedFile) retireStep(start int64, target uint32) (bool, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if start >= f.numPg {
+		return true, nil
+	}
+	end := start + rekeyBatch - 1
+	if end >= f.numPg {
+		end = f.numPg - 1
+	}
+	var stale []page
+	for pgID := start; pgID <= end; pgID++ {
+		if _, ok := f.dirty[pgID]; ok {
+			continue
+		}
+		id, err := f.pageKeyID(pgID)
+		if err != nil {
+			return false, err
+		}
+		if id >= target {
+			continue
+		}
+		pages, err := f.loadPages(pgID, pgID)
+		if err != nil {
+			return false, err
+		}
+		stale = append(stale, pages[0])
+	}
+	// rewrite contiguous runs, as writeRuns requires
+	var runs [][]page
+	for len(stale) > 0 {
+		n := 1
+		for n < len(stale) && stale[n].pgID == stale[n-1].pgID+1 {
+			n++
+		}
+		runs = append(runs, stale[:n])
+		stale = stale[n:]
+	}
+	if len(runs) == 0 {
+		return false, nil
+	}
+	return false, f.writeRuns(runs)
+}
+
+// pageKeyID reads the ID of the data key a page on disk is sealed with
+func (f *EncryptedFile) pageKeyID(pgID int64) (uint32, error) {
+	if f.journal != nil {
+		if sealed, ok := f.journal.pages[pgID]; ok {
+			return binary.BigEndian.Uint32(sealed), nil
+		}
+	}
+	var b [keyIDSize]byte
+	off := headerSize + pgID*f.pgSize
+	if f.pmap != nil {
+		off = f.pmap.offset(f.pmap.pages[pgID].unit)
+	}
+	_, err := f.file.ReadAt(b[:], off)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+// openPage checks that a sealed page is committed to the data key it names,
+// then decrypts it
+func (f *EncryptedFile) openPage(pgID int64, sealed []byte) ([]byte, error) {
+	id := binary.BigEndian.Uint32(sealed)
+	key, ok := f.ringKeys[id]
+	if !ok {
+		return nil, ErrCorruptPage{PageID: pgID}
+	}
+	aead, err := f.dataCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := sealed[keyIDSize : keyIDSize+f.pgNonceSize]
+	ct := sealed[keyIDSize+f.pgNonceSize+f.commitSize:]
+	if f.commitSize > 0 && !suite.VerifyCommitment(key[:], nonce,
+		sealed[keyIDSize+f.pgNonceSize:keyIDSize+f.pgNonceSize+f.commitSize]) {
+		return nil, ErrKeyCommitment{PageID: pgID}
+	}
+	data, err := aead.Open(nil, nonce, ct, f.additionalData(pgID, id))
+	if err != nil {
+		return nil, ErrCorruptPage{PageID: pgID}
+	}
+	return data, nil
+}
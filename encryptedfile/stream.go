@@ -0,0 +1,130 @@
+package encryptedfile
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/awans/fresnel/keys"
+)
+
+// streamPages is how many pages of plaintext ReadFrom and WriteTo move at a
+// time
+const streamPages = 32
+
+var errWhence = errors.New("invalid whence")
+
+// Read implements io.Reader, reading from the current offset. Like os.File,
+// it returns io.EOF only once no bytes are left.
+func (f *EncryptedFile) Read(p []byte) (int, error) {
+	f.offsetM.Lock()
+	defer f.offsetM.Unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Write implements io.Writer, writing at the current offset, or at the end of
+// the file if it was opened with Append
+func (f *EncryptedFile) Write(p []byte) (int, error) {
+	f.offsetM.Lock()
+	defer f.offsetM.Unlock()
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.append {
+		f.offset = f.hdr.Size
+	}
+	n, err := f.writeAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker. Seeking past the end of the file is allowed, and
+// a later Write fills the gap with zeros.
+func (f *EncryptedFile) Seek(offset int64, whence int) (int64, error) {
+	f.offsetM.Lock()
+	defer f.offsetM.Unlock()
+	f.m.RLock()
+	defer f.m.RUnlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.hdr.Size
+	default:
+		return 0, errWhence
+	}
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// ReadFrom implements io.ReaderFrom, writing everything read from r at the
+// current offset a batch of pages at a time
+func (f *EncryptedFile) ReadFrom(r io.Reader) (int64, error) {
+	buf := make([]byte, f.streamSize())
+	defer keys.Wipe(buf)
+	var total int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			written, werr := f.Write(buf[:n])
+			total += int64(written)
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// WriteTo implements io.WriterTo, writing everything from the current offset
+// to the end of the file to w
+func (f *EncryptedFile) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, f.streamSize())
+	defer keys.Wipe(buf)
+	var total int64
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			written, werr := w.Write(buf[:n])
+			total += int64(written)
+			if werr == nil && written < n {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// streamSize returns the plaintext size of streamPages pages
+func (f *EncryptedFile) streamSize() int64 {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	return f.dataPgSize * streamPages
+}
@@ -0,0 +1,160 @@
+package encryptedfile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/awans/fresnel/keys"
+)
+
+// Fault is why a page failed verification
+type Fault int
+
+// Faults
+const (
+	// Corrupt means the page failed authentication or did not decompress
+	Corrupt Fault = iota + 1
+	// Truncated means the page is missing or cut short on disk
+	Truncated
+	// WrongKey means the page names a data key the file does not have, or is
+	// not committed to the key it names
+	WrongKey
+	// RolledBack means the page opens but is not the copy the Merkle tree
+	// records
+	RolledBack
+)
+
+var faultNames = map[Fault]string{
+	Corrupt:    "corrupt",
+	Truncated:  "truncated",
+	WrongKey:   "wrong key",
+	RolledBack: "rolled back",
+}
+
+func (f Fault) String() string {
+	if name, ok := faultNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("fault %d", int(f))
+}
+
+// PageFault is a page that failed verification
+type PageFault struct {
+	PageID int64
+	Fault  Fault
+}
+
+func (p PageFault) String() string {
+	return fmt.Sprintf("page %d: %s", p.PageID, p.Fault)
+}
+
+// Report is what Verify found
+type Report struct {
+	Pages  int64 // pages checked
+	Faults []PageFault
+	// RolledBack is set for a file opened with VerifyOnly whose pages do not
+	// hash to the Merkle root in its header, or to the pinned root. Some
+	// pages were modified or replaced with older copies, but the root alone
+	// cannot tell which.
+	RolledBack bool
+}
+
+// OK reports whether every page verified
+func (r *Report) OK() bool {
+	return len(r.Faults) == 0 && !r.RolledBack
+}
+
+// Verify reads and decrypts every page on disk, bypassing the cache, and
+// reports each one that is corrupt, truncated, sealed with a key the file
+// does not have or, with RollbackProtection, older than the Merkle tree
+// records. Pages still in the write-back buffer are not checked. The error is
+// only for failing to read the file at all. A file too damaged for Open can
+// be checked by opening it with VerifyOnly.
+func (f *EncryptedFile) Verify() (*Report, error) {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+	fi, err := f.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{RolledBack: f.badRoot}
+	numPg := f.numPg
+	if f.pmap == nil {
+		// including a partial page past the last whole one
+		if onDisk := (fi.Size() - headerSize + f.pgSize - 1) / f.pgSize; onDisk > numPg {
+			numPg = onDisk
+		}
+	}
+	if f.tree != nil && f.tree.numLeaves() > numPg {
+		numPg = f.tree.numLeaves()
+	}
+	for pgID := int64(0); pgID < numPg; pgID++ {
+		if _, ok := f.dirty[pgID]; ok {
+			continue
+		}
+		report.Pages++
+		fault, err := f.verifyPage(pgID, fi.Size())
+		if err != nil {
+			return nil, err
+		}
+		if fault != 0 {
+			report.Faults = append(report.Faults, PageFault{PageID: pgID, Fault: fault})
+		}
+	}
+	return report, nil
+}
+
+// verifyPage checks a single page on disk, returning zero if it is intact
+func (f *EncryptedFile) verifyPage(pgID int64, fileSize int64) (Fault, error) {
+	off, size := headerSize+pgID*f.pgSize, f.pgSize
+	if f.pmap != nil {
+		if pgID >= int64(len(f.pmap.pages)) {
+			return Truncated, nil
+		}
+		e := f.pmap.pages[pgID]
+		off, size = f.pmap.offset(e.unit), e.n*f.pmap.unitSize
+	}
+	// a page still in the journal is checked as the file will hold it
+	var sealed []byte
+	if f.journal != nil {
+		sealed = f.journal.pages[pgID]
+	}
+	if sealed == nil {
+		if off+size > fileSize {
+			return Truncated, nil
+		}
+		sealed = make([]byte, size)
+		_, err := f.file.ReadAt(sealed, off)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+	if _, ok := f.ringKeys[binary.BigEndian.Uint32(sealed)]; !ok {
+		return WrongKey, nil
+	}
+	data, err := f.openPage(pgID, sealed)
+	if _, ok := err.(ErrKeyCommitment); ok {
+		return WrongKey, nil
+	}
+	if err != nil {
+		return Corrupt, nil
+	}
+	if f.pmap != nil {
+		frame := data
+		data, err = f.unframe(pgID, frame)
+		keys.Wipe(frame)
+		if err != nil {
+			return Corrupt, nil
+		}
+	}
+	keys.Wipe(data)
+	if f.tree != nil && (pgID >= f.tree.numLeaves() || leafHash(sealed) != f.tree.leaf(pgID)) {
+		return RolledBack, nil
+	}
+	return 0, nil
+}
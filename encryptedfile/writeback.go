@@ -0,0 +1,81 @@
+package encryptedfile
+
+import (
+	"sort"
+
+	"github.com/awans/fresnel/keys"
+)
+
+// bufferPages holds modified pages in memory instead of sealing them
+// immediately, flushing every dirty page once the buffer is over budget
+func (f *EncryptedFile) bufferPages(pages []page) error {
+	for _, pg := range pages {
+		if old, ok := f.dirty[pg.pgID]; ok {
+			keys.Wipe(old)
+		} else {
+			f.dirtySize += int64(len(pg.Data))
+		}
+		f.dirty[pg.pgID] = pg.Data
+		if pg.pgID >= f.numPg {
+			f.numPg = pg.pgID + 1
+		}
+	}
+	if f.dirtySize > f.writeBack {
+		return f.flush()
+	}
+	return nil
+}
+
+// flush seals and writes every dirty page as one journaled set of writes, one
+// per contiguous run
+func (f *EncryptedFile) flush() error {
+	if len(f.dirty) == 0 {
+		return nil
+	}
+	ids := make([]int64, 0, len(f.dirty))
+	for pgID := range f.dirty {
+		ids = append(ids, pgID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var runs [][]page
+	var run []page
+	for i, pgID := range ids {
+		run = append(run, page{Data: f.dirty[pgID], pgID: pgID})
+		if i == len(ids)-1 || ids[i+1] != pgID+1 {
+			runs = append(runs, run)
+			run = nil
+		}
+	}
+	err := f.writeRuns(runs)
+	if err != nil {
+		return err
+	}
+	for _, pgID := range ids {
+		delete(f.dirty, pgID)
+	}
+	f.dirtySize = 0
+	return nil
+}
+
+// dirtyPage returns a copy of a buffered page
+func (f *EncryptedFile) dirtyPage(pgID int64) ([]byte, bool) {
+	data, ok := f.dirty[pgID]
+	if !ok {
+		return nil, false
+	}
+	rv := make([]byte, len(data))
+	copy(rv, data)
+	return rv, true
+}
+
+// truncateDirty drops buffered pages at or after pgID
+func (f *EncryptedFile) truncateDirty(pgID int64) {
+	for id, data := range f.dirty {
+		if id >= pgID {
+			f.dirtySize -= int64(len(data))
+			keys.Wipe(data)
+			delete(f.dirty, id)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package encryptedkv
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrWrongKey is returned by New when the key does not match the one the
+// store was written with
+var ErrWrongKey = errors.New("wrong key")
+
+// ErrReadOnly is returned by Writer and by key changes for a store opened
+// with config["read_only"]
+var ErrReadOnly = errors.New("store is open read-only")
+
+var errEmptyReadOnly = errors.New("cannot create a store opened read-only")
+
+// ErrCorruptBatch is returned when a stored batch fails authentication
+type ErrCorruptBatch struct {
+	Seq uint64
+}
+
+func (e ErrCorruptBatch) Error() string {
+	return fmt.Sprintf("batch %d failed authentication", e.Seq)
+}
+
+// ErrKeyCommitment is returned when a stored batch is not committed to the
+// data key it names, which means it was modified or crafted to open under
+// more than one key
+type ErrKeyCommitment struct {
+	Seq uint64
+}
+
+func (e ErrKeyCommitment) Error() string {
+	return fmt.Sprintf("batch %d failed its key commitment check", e.Seq)
+}
@@ -0,0 +1,175 @@
+package encryptedkv
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"io"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// dataKeyKey holds the store's data key wrapped under each key-encryption key
+var dataKeyKey = []byte("\x00datakey")
+
+// wrappedKey is the data key sealed under one key-encryption key
+type wrappedKey struct {
+	Nonce  [nonceSize]byte
+	Sealed []byte
+}
+
+func wrapKey(kek [32]byte, dek [32]byte) (wrappedKey, error) {
+	var w wrappedKey
+	_, err := io.ReadFull(rand.Reader, w.Nonce[:])
+	if err != nil {
+		return w, err
+	}
+	w.Sealed = secretbox.Seal(nil, dek[:], &w.Nonce, &kek)
+	return w, nil
+}
+
+func (w wrappedKey) unwrap(kek [32]byte) ([32]byte, bool) {
+	var dek [32]byte
+	out, ok := secretbox.Open(nil, w.Sealed, &w.Nonce, &kek)
+	if !ok || len(out) != len(dek) {
+		return dek, false
+	}
+	copy(dek[:], out)
+	return dek, true
+}
+
+func (s *Store) loadWrappedKeys() ([]wrappedKey, error) {
+	b, err := s.db.Get(dataKeyKey, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var wrapped []wrappedKey
+	err = gob.NewDecoder(bytes.NewReader(b)).Decode(&wrapped)
+	return wrapped, err
+}
+
+func (s *Store) saveWrappedKeys(wrapped []wrappedKey) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(wrapped)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(dataKeyKey, buf.Bytes(), nil)
+}
+
+// openDataKey sets the store's data key by unwrapping it with kek. A new
+// store gets a random data key, and a store written before data keys were
+// wrapped keeps using kek as its data key.
+func (s *Store) openDataKey(kek [32]byte) error {
+	wrapped, err := s.loadWrappedKeys()
+	if err != nil {
+		return err
+	}
+	for _, w := range wrapped {
+		if dek, ok := w.unwrap(kek); ok {
+			*s.key = dek
+			return nil
+		}
+	}
+	if wrapped != nil {
+		return ErrWrongKey
+	}
+
+	if !s.empty() {
+		*s.key = kek
+	} else {
+		_, err = io.ReadFull(rand.Reader, s.key[:])
+		if err != nil {
+			return err
+		}
+	}
+	// the data key is only wrapped once checkKey has accepted it
+	s.pendingKEK = &kek
+	return nil
+}
+
+// empty reports whether nothing has been written to the store yet
+func (s *Store) empty() bool {
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+	return !iter.First()
+}
+
+func (s *Store) savePendingKEK() error {
+	if s.readOnly {
+		// a store written before data keys were wrapped keeps using kek
+		return nil
+	}
+	if s.pendingKDF != nil {
+		err := s.saveKDFParams(*s.pendingKDF)
+		if err != nil {
+			return err
+		}
+		s.pendingKDF = nil
+	}
+	if s.pendingKEK == nil {
+		return nil
+	}
+	w, err := wrapKey(*s.pendingKEK, *s.key)
+	if err != nil {
+		return err
+	}
+	s.pendingKEK = nil
+	return s.saveWrappedKeys([]wrappedKey{w})
+}
+
+// AddKey lets kek open the store as well as the keys that already can. Each
+// key-encryption key only wraps the store's data key, so no batches are
+// rewritten.
+func (s *Store) AddKey(kek [32]byte) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	wrapped, err := s.loadWrappedKeys()
+	if err != nil {
+		return err
+	}
+	for _, w := range wrapped {
+		if _, ok := w.unwrap(kek); ok {
+			return nil
+		}
+	}
+	w, err := wrapKey(kek, *s.key)
+	if err != nil {
+		return err
+	}
+	return s.saveWrappedKeys(append(wrapped, w))
+}
+
+// RemoveKey stops kek from opening the store. The last key cannot be removed.
+func (s *Store) RemoveKey(kek [32]byte) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	wrapped, err := s.loadWrappedKeys()
+	if err != nil {
+		return err
+	}
+	var kept []wrappedKey
+	for _, w := range wrapped {
+		if _, ok := w.unwrap(kek); !ok {
+			kept = append(kept, w)
+		}
+	}
+	if len(kept) == len(wrapped) {
+		return ErrWrongKey
+	}
+	if len(kept) == 0 {
+		return errors.New("cannot remove the only key")
+	}
+	return s.saveWrappedKeys(kept)
+}
@@ -0,0 +1,156 @@
+package encryptedkv
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/awans/fresnel/keys"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// ErrNoPassphrase is returned by New when a passphrase is given for a store
+// that was created with a raw key and never given one
+var ErrNoPassphrase = keys.ErrNoPassphrase
+
+// kdfKey holds the parameters passphrases are stretched with
+var kdfKey = []byte("\x00kdf")
+
+func (s *Store) loadKDFParams() (*keys.KDFParams, error) {
+	b, err := s.db.Get(kdfKey, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	params := &keys.KDFParams{}
+	err = binary.Read(bytes.NewReader(b), binary.BigEndian, params)
+	if err != nil {
+		return nil, err
+	}
+	return params, params.Validate()
+}
+
+func (s *Store) saveKDFParams(params keys.KDFParams) error {
+	var buf bytes.Buffer
+	err := binary.Write(&buf, binary.BigEndian, params)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(kdfKey, buf.Bytes(), nil)
+}
+
+// resolveKey asks p for the key-encryption key. A new store opened with a
+// passphrase records params along with its wrapped data key; a store created
+// with a raw key has no parameters.
+func (s *Store) resolveKey(p keys.KeyProvider, params keys.KDFParams) ([32]byte, error) {
+	stored, err := s.loadKDFParams()
+	if err != nil {
+		return [32]byte{}, err
+	}
+	var kek [32]byte
+	switch {
+	case stored != nil:
+		kek, err = p.Key(*stored)
+	case !s.empty():
+		kek, err = p.Key(keys.KDFParams{})
+	default:
+		kek, params, err = keys.NewKey(p, params)
+		if err == nil && params.Algorithm != keys.KDFNone {
+			s.pendingKDF = &params
+		}
+	}
+	if err != nil {
+		return kek, err
+	}
+	*s.kek = kek
+	return kek, nil
+}
+
+// RefreshKey asks the store's key provider for its key again. If the key has
+// changed, the data key is wrapped under the new key and unwrapped from the
+// old one, so the provider can rotate keys while the store is open.
+func (s *Store) RefreshKey() error {
+	params, err := s.loadKDFParams()
+	if err != nil {
+		return err
+	}
+	if params == nil {
+		params = &keys.KDFParams{}
+	}
+	kek, err := s.provider.Key(*params)
+	if err != nil {
+		return err
+	}
+	s.writeLock.Lock()
+	old := *s.kek
+	s.writeLock.Unlock()
+	if kek == old {
+		return nil
+	}
+	err = s.AddKey(kek)
+	if err != nil {
+		return err
+	}
+	err = s.RemoveKey(old)
+	if err != nil && err != ErrWrongKey {
+		return err
+	}
+	s.writeLock.Lock()
+	*s.kek = kek
+	s.writeLock.Unlock()
+	return nil
+}
+
+// passphraseKey derives the key-encryption key for passphrase. For a store
+// created with a raw key it also returns new Argon2id parameters, which are
+// only saved once the key is added.
+func (s *Store) passphraseKey(passphrase []byte) ([32]byte, *keys.KDFParams, error) {
+	if s.readOnly {
+		return [32]byte{}, nil, ErrReadOnly
+	}
+	params, err := s.loadKDFParams()
+	if err != nil {
+		return [32]byte{}, nil, err
+	}
+	var fresh *keys.KDFParams
+	if params == nil {
+		p, err := keys.NewKDFParams(keys.KDFArgon2id)
+		if err != nil {
+			return [32]byte{}, nil, err
+		}
+		params, fresh = &p, &p
+	}
+	kek, err := keys.DeriveKey(passphrase, *params)
+	return kek, fresh, err
+}
+
+// AddPassphrase lets passphrase open the store, as well as the keys that
+// already can
+func (s *Store) AddPassphrase(passphrase []byte) error {
+	kek, params, err := s.passphraseKey(passphrase)
+	if err != nil {
+		return err
+	}
+	err = s.AddKey(kek)
+	if err != nil || params == nil {
+		return err
+	}
+	return s.saveKDFParams(*params)
+}
+
+// RemovePassphrase stops passphrase from opening the store
+func (s *Store) RemovePassphrase(passphrase []byte) error {
+	params, err := s.loadKDFParams()
+	if err != nil {
+		return err
+	}
+	if params == nil {
+		return ErrNoPassphrase
+	}
+	kek, err := keys.Passphrase(passphrase).Key(*params)
+	if err != nil {
+		return err
+	}
+	return s.RemoveKey(kek)
+}
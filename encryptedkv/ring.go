@@ -0,0 +1,300 @@
+package encryptedkv
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+
+	"github.com/awans/fresnel/keys"
+	"github.com/awans/fresnel/suite"
+	"github.com/syndtr/goleveldb/leveldb"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// ringKey holds the store's data keys, sealed under the store key. Each
+// batch names the data key it is sealed with, so new batches use the newest
+// key while older batches stay readable until they are rewritten.
+var ringKey = []byte("\x00ring")
+
+// maxRingKeys is how many data keys a store can hold at once
+const maxRingKeys = 8
+
+// keyIDSize is the size of the key ID at the start of every sealed batch
+const keyIDSize = 4
+
+type ringRecord struct {
+	// FirstSeq is the first batch written after the ring was created; older
+	// batches may still be sealed directly with the store key
+	FirstSeq uint64
+	Keys     []ringEntry
+	// Suite is the cipher suite batches are sealed with. Committed is set if
+	// batches carry key commitments.
+	Suite     uint16
+	Committed bool
+}
+
+type ringEntry struct {
+	ID  uint32
+	Key [32]byte
+}
+
+// loadRing reads the key ring, if the store has one yet
+func (s *Store) loadRing() error {
+	b, err := s.db.Get(ringKey, nil)
+	if err == leveldb.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(b) < nonceSize {
+		return errors.New("corrupt key ring")
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], b)
+	plain, ok := secretbox.Open(nil, b[nonceSize:], &nonce, s.key)
+	if !ok {
+		return errors.New("corrupt key ring")
+	}
+	defer keys.Wipe(plain)
+	var rec ringRecord
+	err = gob.NewDecoder(bytes.NewReader(plain)).Decode(&rec)
+	if err != nil {
+		return err
+	}
+	defer rec.wipe()
+	if len(rec.Keys) > maxRingKeys {
+		return errors.New("corrupt key ring")
+	}
+	s.setRing(rec)
+	s.committed = rec.Committed
+	s.suite, err = suite.ByID(rec.Suite)
+	return err
+}
+
+func (r *ringRecord) wipe() {
+	for i := range r.Keys {
+		keys.Wipe(r.Keys[i].Key[:])
+	}
+}
+
+func (s *Store) setRing(rec ringRecord) {
+	s.ring = make(map[uint32]*[32]byte)
+	s.keyID = 0
+	for i, e := range rec.Keys {
+		key := s.ringSlot(i)
+		*key = e.Key
+		s.ring[e.ID] = key
+		if e.ID > s.keyID {
+			s.keyID = e.ID
+		}
+	}
+	s.firstSeq = rec.FirstSeq
+}
+
+// ringSlot returns the i'th slot of locked memory for data keys
+func (s *Store) ringSlot(i int) *[32]byte {
+	return s.mem.Key(2 + i)
+}
+
+// freeRingSlot returns a slot no data key is using
+func (s *Store) freeRingSlot() *[32]byte {
+	for i := 0; i < maxRingKeys; i++ {
+		slot, used := s.ringSlot(i), false
+		for _, key := range s.ring {
+			if key == slot {
+				used = true
+			}
+		}
+		if !used {
+			return slot
+		}
+	}
+	return nil
+}
+
+func (s *Store) saveRing() error {
+	rec := ringRecord{FirstSeq: s.firstSeq, Suite: s.suite.ID(), Committed: s.committed}
+	for id, key := range s.ring {
+		rec.Keys = append(rec.Keys, ringEntry{ID: id, Key: *key})
+	}
+	defer rec.wipe()
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(rec)
+	defer keys.Wipe(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	var nonce [nonceSize]byte
+	_, err = io.ReadFull(rand.Reader, nonce[:])
+	if err != nil {
+		return err
+	}
+	out := secretbox.Seal(nonce[:], buf.Bytes(), &nonce, s.key)
+	return s.db.Put(ringKey, out, nil)
+}
+
+// newRingKey adds a random data key to the ring, which new batches are then
+// sealed with
+func (s *Store) newRingKey() error {
+	if s.ring == nil {
+		s.ring = make(map[uint32]*[32]byte)
+		s.firstSeq = s.seq + 1
+	}
+	key := s.freeRingSlot()
+	if key == nil {
+		return errors.New("key ring is full; retire old data keys first")
+	}
+	_, err := io.ReadFull(rand.Reader, key[:])
+	if err != nil {
+		return err
+	}
+	s.keyID++
+	s.ring[s.keyID] = key
+	return s.saveRing()
+}
+
+// RotateDataKey adds a fresh data key to the ring. Batches written from now
+// on are sealed with it, while older batches stay readable until
+// RetireDataKeys rewrites them.
+func (s *Store) RotateDataKey() error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	return s.newRingKey()
+}
+
+// RetireDataKeys rewrites every batch sealed with an older data key than the
+// newest, then removes the older keys from the ring. Batches are rewritten in
+// groups, releasing the store between them so writes can continue.
+func (s *Store) RetireDataKeys() error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	s.writeLock.Lock()
+	target := s.keyID
+	current := make(map[uint32]*[32]byte)
+	for id, key := range s.ring {
+		if id >= target {
+			current[id] = key
+		}
+	}
+	s.writeLock.Unlock()
+
+	var stale [][]byte
+	iter := s.db.NewIterator(nil, nil)
+	for iter.Next() {
+		if isMetaKey(iter.Key()) {
+			continue
+		}
+		seq, err := binary.ReadUvarint(bytes.NewReader(iter.Key()))
+		if err != nil {
+			iter.Release()
+			return err
+		}
+		batch, err := s.openRing(current, seq, iter.Value())
+		if err != nil {
+			stale = append(stale, append([]byte(nil), iter.Key()...))
+		}
+		keys.Wipe(batch)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	for len(stale) > 0 {
+		n := len(stale)
+		if n > retireBatch {
+			n = retireBatch
+		}
+		err := s.rewriteBatches(stale[:n])
+		if err != nil {
+			return err
+		}
+		stale = stale[n:]
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	for id, key := range s.ring {
+		if id < target {
+			keys.Wipe(key[:])
+			delete(s.ring, id)
+		}
+	}
+	// no batch is sealed directly with the store key any more
+	s.firstSeq = 0
+	return s.saveRing()
+}
+
+// retireBatch is how many batches are rewritten under one hold of the lock
+const retireBatch = 256
+
+func (s *Store) rewriteBatches(batchKeys [][]byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	for _, k := range batchKeys {
+		seq, err := binary.ReadUvarint(bytes.NewReader(k))
+		if err != nil {
+			return err
+		}
+		sealed, err := s.db.Get(k, nil)
+		if err != nil {
+			return err
+		}
+		batch, err := openBatch(s, seq, sealed)
+		if err != nil {
+			return err
+		}
+		out, err := sealBatch(s, seq, batch)
+		keys.Wipe(batch)
+		if err != nil {
+			return err
+		}
+		err = s.db.Put(k, out, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errNotInRing means a batch does not name a data key in the ring
+var errNotInRing = errors.New("batch not sealed with a key in the ring")
+
+// openRing checks that batch seq is committed to the data key it names, if
+// the store commits to keys, then opens it
+func (s *Store) openRing(ring map[uint32]*[32]byte, seq uint64, sealed []byte) ([]byte, error) {
+	if len(sealed) < keyIDSize {
+		return nil, errNotInRing
+	}
+	id := binary.BigEndian.Uint32(sealed)
+	key, ok := ring[id]
+	if !ok {
+		return nil, errNotInRing
+	}
+	aead, err := s.suite.New(key[:])
+	if err != nil {
+		return nil, err
+	}
+	ns := aead.NonceSize()
+	if len(sealed) < keyIDSize+ns+s.commitSize() {
+		return nil, ErrCorruptBatch{Seq: seq}
+	}
+	nonce := sealed[keyIDSize : keyIDSize+ns]
+	ct := sealed[keyIDSize+ns+s.commitSize():]
+	if s.committed && !suite.VerifyCommitment(key[:], nonce, sealed[keyIDSize+ns:keyIDSize+ns+s.commitSize()]) {
+		return nil, ErrKeyCommitment{Seq: seq}
+	}
+	batch, err := aead.Open(nil, nonce, ct, batchAdditionalData(seq, id))
+	if err != nil {
+		return nil, ErrCorruptBatch{Seq: seq}
+	}
+	return batch, nil
+}
@@ -2,22 +2,142 @@ package encryptedkv
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
-	"errors"
 	"io"
-	"log"
 	mrand "math/rand"
 
+	"github.com/awans/fresnel/keys"
+	"github.com/awans/fresnel/suite"
+	"github.com/syndtr/goleveldb/leveldb"
 	"golang.org/x/crypto/nacl/secretbox"
 )
 
 const nonceSize = 24
+const saltSize = 16
+
+// Store metadata lives under keys starting with a zero byte, which no batch
+// key does because batch sequence numbers start at one.
+func isMetaKey(k []byte) bool {
+	return len(k) > 0 && k[0] == 0
+}
+
+// keyCheckKey holds a salted MAC of the store key
+var keyCheckKey = []byte("\x00keycheck")
+
+func keyCheckValue(key [32]byte, salt []byte) []byte {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte("fresnel key check"))
+	mac.Write(salt)
+	rv := make([]byte, 0, saltSize+sha256.Size)
+	rv = append(rv, salt...)
+	return mac.Sum(rv)
+}
+
+// checkKey verifies the store key against the stored check value, creating
+// one if the store does not have it yet
+func (s *Store) checkKey() error {
+	stored, err := s.db.Get(keyCheckKey, nil)
+	if err == nil {
+		if len(stored) != saltSize+sha256.Size ||
+			!hmac.Equal(stored, keyCheckValue(*s.key, stored[:saltSize])) {
+			return ErrWrongKey
+		}
+		return nil
+	}
+	if err != leveldb.ErrNotFound {
+		return err
+	}
+
+	// stores written before the check value existed are checked against
+	// their first batch instead
+	iter := s.db.NewIterator(nil, nil)
+	var batchErr error
+	for iter.Next() {
+		if !isMetaKey(iter.Key()) {
+			var seq uint64
+			seq, batchErr = binary.ReadUvarint(bytes.NewReader(iter.Key()))
+			if batchErr == nil {
+				_, batchErr = openBatch(s, seq, iter.Value())
+			}
+			break
+		}
+	}
+	iter.Release()
+	if batchErr != nil {
+		return ErrWrongKey
+	}
+	if s.readOnly {
+		return nil
+	}
+	salt := make([]byte, saltSize)
+	_, err = io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(keyCheckKey, keyCheckValue(*s.key, salt), nil)
+}
+
+// openBatch decrypts a stored batch with the data key it names. Batches
+// written before the store had a key ring are sealed directly with the store
+// key, without a key ID.
+func openBatch(s *Store, seq uint64, encryptedBatch []byte) ([]byte, error) {
+	batch, err := s.openRing(s.ring, seq, encryptedBatch)
+	if err == nil {
+		return batch, nil
+	}
+	if s.ring != nil && seq >= s.firstSeq {
+		if err == errNotInRing {
+			err = ErrCorruptBatch{Seq: seq}
+		}
+		return nil, err
+	}
+	if len(encryptedBatch) < nonceSize {
+		return nil, ErrCorruptBatch{Seq: seq}
+	}
+	// First 24 bytes of the encryptedBatch is the nonce
+	nonce := new([nonceSize]byte)
+	copy(nonce[:], encryptedBatch[:nonceSize])
+	batch, ok := secretbox.Open(nil, encryptedBatch[nonceSize:], nonce, s.key)
+	if !ok {
+		return nil, ErrCorruptBatch{Seq: seq}
+	}
+	return batch, nil
+}
+
+// sealBatch encrypts batch seq with the newest data key, prefixed by its ID,
+// its nonce and, if the store commits to keys, a commitment to the key
+func sealBatch(s *Store, seq uint64, batch []byte) ([]byte, error) {
+	key := s.ring[s.keyID]
+	aead, err := s.suite.New(key[:])
+	if err != nil {
+		return nil, err
+	}
+	ns := aead.NonceSize()
+	out := make([]byte, keyIDSize+ns+s.commitSize(), keyIDSize+ns+s.commitSize()+len(batch)+aead.Overhead())
+	binary.BigEndian.PutUint32(out, s.keyID)
+	nonce := out[keyIDSize : keyIDSize+ns]
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if s.committed {
+		c := suite.Commit(key[:], nonce)
+		copy(out[keyIDSize+ns:], c[:])
+	}
+	return aead.Seal(out, nonce, batch, batchAdditionalData(seq, s.keyID)), nil
+}
 
 func (s *Store) loadFromFile() error {
 	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
 	for iter.Next() {
+		if isMetaKey(iter.Key()) {
+			continue
+		}
 		keyReader := bytes.NewReader(iter.Key())
 		seq, err := binary.ReadUvarint(keyReader)
 		if err != nil {
@@ -25,20 +145,16 @@ func (s *Store) loadFromFile() error {
 		}
 		s.seq = seq
 
-		encryptedBatch := iter.Value()
-
-		// First 24 bytes of the encryptedBatch is the nonce
-		nonce := new([nonceSize]byte)
-		copy(nonce[:], encryptedBatch[:nonceSize])
-		batch, ok := secretbox.Open(nil, encryptedBatch[nonceSize:], nonce, &s.key)
-		if !ok {
-			return errors.New("Decryption failed")
+		batch, err := openBatch(s, seq, iter.Value())
+		if err != nil {
+			return err
 		}
 		reader := bytes.NewReader(batch)
 		decoder := gob.NewDecoder(reader)
 
 		var kvList []Item
 		err = decoder.Decode(&kvList)
+		keys.Wipe(batch)
 		if err != nil && err != io.EOF {
 			return err
 		}
@@ -48,27 +164,32 @@ func (s *Store) loadFromFile() error {
 			s.treap = s.treap.Upsert(&Item{K: item.K, V: item.V}, mrand.Int())
 		}
 	}
-	iter.Release()
 	return iter.Error()
 }
 
+// writeBatchToFile seals items as the next batch and stores it. The sequence
+// number only advances once the batch is stored.
 func writeBatchToFile(s *Store, items []Item) error {
 	var buf bytes.Buffer
 	encoder := gob.NewEncoder(&buf)
 	err := encoder.Encode(items)
+	if err != nil {
+		keys.Wipe(buf.Bytes())
+		return err
+	}
 
-	nonce := new([nonceSize]byte)
-	_, err = io.ReadFull(rand.Reader, nonce[:])
+	encryptedBatch, err := sealBatch(s, s.seq+1, buf.Bytes())
+	keys.Wipe(buf.Bytes())
 	if err != nil {
-		log.Fatalln("Could not read from random:", err)
+		return err
 	}
-	out := make([]byte, nonceSize)
-	copy(out, nonce[:])
-	encryptedBatch := secretbox.Seal(out, buf.Bytes(), nonce, &s.key)
 
 	keyBuf := make([]byte, binary.MaxVarintLen64)
 	binary.PutUvarint(keyBuf, s.seq+1)
+	err = s.db.Put(keyBuf, encryptedBatch, nil)
+	if err != nil {
+		return err
+	}
 	s.seq++
-	s.db.Put(keyBuf, encryptedBatch, nil)
 	return nil
 }
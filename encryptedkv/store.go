@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"sync"
 
+	"github.com/awans/fresnel/keys"
+	"github.com/awans/fresnel/suite"
 	"github.com/blevesearch/bleve/index/store"
 	"github.com/blevesearch/bleve/registry"
 	"github.com/steveyen/gtreap"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
 // Name is the name of this kvstore impl
@@ -21,8 +24,21 @@ type Store struct {
 	mo        store.MergeOperator
 	writeLock sync.Mutex
 	db        *leveldb.DB
-	key       [32]byte
+	mem       *keys.Memory
+	key       *[32]byte // store key
 	seq       uint64
+
+	ring      map[uint32]*[32]byte // data keys by ID, in mem
+	keyID     uint32               // newest data key, which batches are sealed with
+	firstSeq  uint64
+	suite     suite.Suite // cipher suite batches are sealed with
+	committed bool        // batches carry a commitment to their data key
+	readOnly  bool
+
+	kek        *[32]byte // key-encryption key the store was opened with
+	provider   keys.KeyProvider
+	pendingKEK *[32]byte
+	pendingKDF *keys.KDFParams
 }
 
 // Item represents a kv pair
@@ -35,25 +51,50 @@ func itemCompare(a, b interface{}) int {
 	return bytes.Compare(a.(*Item).K, b.(*Item).K)
 }
 
-// New returns a new encryptedkv KV
+// New returns a new encryptedkv KV. The key-encryption key that wraps the
+// store's random data key comes from the key provider described by
+// keys.FromConfig. A passphrase is stretched with the keys.KDFParams in
+// config["kdf"] when the store is created. If config["tenant"] is set, the
+// store is opened with that tenant's key derived from the provided master
+// key; keys from a keys.Registry are already per tenant and are used without
+// it. A new store seals batches with the cipher suite named by
+// config["cipher"], as accepted by suite.Parse. As with bleve's own stores,
+// config["read_only"] opens an existing store that cannot be written, and
+// config["create_if_missing"] and config["error_if_exists"] control whether
+// a store is created.
 func New(mo store.MergeOperator, config map[string]interface{}) (store.KVStore, error) {
+	s, err := openStore(mo, config, true)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// openStore opens the store described by config, replaying its batches if load is
+// set
+func openStore(mo store.MergeOperator, config map[string]interface{}, load bool) (*Store, error) {
 	treap := gtreap.NewTreap(itemCompare)
 
-	in, ok := config["key"].([]byte)
-	if !ok {
-		return nil, fmt.Errorf("must provide [32]byte key")
+	provider, err := keys.FromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if tenant, ok := config["tenant"].(string); ok {
+		provider = keys.Tenant(provider, tenant, Name)
 	}
-
-	key := new([32]byte)
-	copy(key[:], in[:32])
 
 	path, ok := config["path"].(string)
 	if !ok {
 		return nil, fmt.Errorf("must specify path")
 	}
 
-	db, err := leveldb.OpenFile(path, nil)
+	mem, err := keys.NewMemory(memKeys)
+	if err != nil {
+		return nil, err
+	}
+	db, err := leveldb.OpenFile(path, openOptions(config))
 	if err != nil {
+		mem.Free()
 		return nil, err
 	}
 
@@ -63,21 +104,88 @@ func New(mo store.MergeOperator, config map[string]interface{}) (store.KVStore,
 		mo:        mo,
 		writeLock: sync.Mutex{},
 		db:        db,
-		key:       *key,
+		mem:       mem,
+		key:       mem.Key(0),
+		kek:       mem.Key(1),
+		provider:  provider,
+	}
+	rv.readOnly, _ = config["read_only"].(bool)
+	if rv.readOnly && rv.empty() {
+		rv.Close()
+		return nil, errEmptyReadOnly
 	}
 
-	err = rv.loadFromFile()
+	params, _ := config["kdf"].(keys.KDFParams)
+	kek, err := rv.resolveKey(provider, params)
+	if err == nil {
+		err = rv.openDataKey(kek)
+	}
+	if err == nil {
+		err = rv.checkKey()
+	}
+	if err == nil {
+		err = rv.savePendingKEK()
+	}
 	if err != nil {
+		rv.Close()
+		return nil, err
+	}
+
+	err = rv.loadRing()
+	if err == nil {
+		err = rv.loadSuite(config)
+	}
+	if err == nil && load {
+		err = rv.loadFromFile()
+	}
+	if err == nil && load && rv.ring == nil && !rv.readOnly {
+		err = rv.newRingKey()
+	}
+	if err != nil {
+		rv.Close()
 		return nil, err
 	}
 
 	return &rv, nil
 }
 
-// Close closes this store
+// openOptions returns the leveldb options for config["read_only"],
+// config["create_if_missing"] and config["error_if_exists"]
+func openOptions(config map[string]interface{}) *opt.Options {
+	o := &opt.Options{}
+	o.ReadOnly, _ = config["read_only"].(bool)
+	o.ErrorIfExist, _ = config["error_if_exists"].(bool)
+	if createIfMissing, ok := config["create_if_missing"].(bool); ok {
+		o.ErrorIfMissing = !createIfMissing
+	}
+	return o
+}
+
+// memKeys is how many keys a store holds in locked memory: the store key,
+// the key-encryption key and the data keys of the ring
+const memKeys = 2 + maxRingKeys
+
+// Close closes this store, wiping its keys and every key and value it holds
+// in memory. Readers must not be used after Close.
 func (s *Store) Close() error {
-	// TODO close the file
-	return nil
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	err := s.db.Close()
+
+	s.readLock.Lock()
+	s.treap.VisitAscend(&Item{}, func(i gtreap.Item) bool {
+		item := i.(*Item)
+		keys.Wipe(item.K)
+		keys.Wipe(item.V)
+		return true
+	})
+	s.treap = gtreap.NewTreap(itemCompare)
+	s.readLock.Unlock()
+
+	s.ring = nil
+	s.mem.Free()
+	s.key, s.kek = new([32]byte), new([32]byte)
+	return err
 }
 
 // Reader returns a KV reader
@@ -88,8 +196,11 @@ func (s *Store) Reader() (store.KVReader, error) {
 	return &rv, nil
 }
 
-// Writer returns a KV writer
+// Writer returns a KV writer, or ErrReadOnly if the store was opened read-only
 func (s *Store) Writer() (store.KVWriter, error) {
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
 	return &Writer{s}, nil
 }
 
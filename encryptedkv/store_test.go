@@ -13,11 +13,16 @@
 package encryptedkv
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
 	"os"
 	"testing"
 
+	"github.com/awans/fresnel/storetest"
 	"github.com/blevesearch/bleve/index/store"
-	"github.com/blevesearch/bleve/index/store/test"
+	"github.com/syndtr/goleveldb/leveldb"
+	"golang.org/x/crypto/nacl/secretbox"
 )
 
 func open(t *testing.T, mo store.MergeOperator) store.KVStore {
@@ -41,56 +46,289 @@ func cleanup(t *testing.T, s store.KVStore) {
 	}
 }
 
-func TestEncryptedKVKVCrud(t *testing.T) {
-	s := open(t, nil)
-	defer cleanup(t, s)
-	test.CommonTestKVCrud(t, s)
+var backend = storetest.Backend{
+	New: New,
+	Verify: func(config map[string]interface{}) (bool, error) {
+		report, err := Verify(config)
+		if err != nil {
+			return false, err
+		}
+		return report.OK(), nil
+	},
+	ErrWrongKey:     ErrWrongKey,
+	ErrNoPassphrase: ErrNoPassphrase,
+	ErrReadOnly:     ErrReadOnly,
 }
 
-func TestEncryptedKVReaderIsolation(t *testing.T) {
-	s := open(t, nil)
-	defer cleanup(t, s)
-	test.CommonTestReaderIsolation(t, s)
+func TestEncryptedKVStore(t *testing.T) {
+	storetest.Run(t, backend)
 }
 
-func TestEncryptedKVReaderOwnsGetBytes(t *testing.T) {
+func TestEncryptedKVCloseWipesMemory(t *testing.T) {
 	s := open(t, nil)
-	defer cleanup(t, s)
-	test.CommonTestReaderOwnsGetBytes(t, s)
+	defer os.RemoveAll("test")
+
+	w, err := s.Writer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := w.NewBatch()
+	b.Set([]byte("secret"), []byte("value"))
+	err = w.ExecuteBatch(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	item := s.(*Store).treap.Get(&Item{K: []byte("secret")}).(*Item)
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(item.K) == "secret" || string(item.V) == "value" {
+		t.Fatal("expected Close to wipe keys and values")
+	}
+	if *s.(*Store).key != ([32]byte{}) || s.(*Store).ring != nil {
+		t.Fatal("expected Close to wipe the store's keys")
+	}
 }
 
-func TestEncryptedKVWriterOwnsBytes(t *testing.T) {
-	s := open(t, nil)
-	defer cleanup(t, s)
-	test.CommonTestWriterOwnsBytes(t, s)
+func TestEncryptedKVCipherSuite(t *testing.T) {
+	for _, name := range []string{"xchacha20-poly1305", "aes-256-gcm", "aes-256-gcm-siv"} {
+		config := map[string]interface{}{"key": []byte("testtesttesttesttesttesttesttesttest"),
+			"path": "test", "cipher": name}
+		s, err := New(nil, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := s.Writer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := w.NewBatch()
+		b.Set([]byte("k"), []byte(name))
+		err = w.ExecuteBatch(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		err = s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// reopening with a different suite uses the recorded one
+		config["cipher"] = "xchacha20-poly1305"
+		s, err = New(nil, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.(*Store).suite.String() != name {
+			t.Fatalf("expected suite %s, got %s", name, s.(*Store).suite)
+		}
+		r, err := s.Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := r.Get([]byte("k"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != name {
+			t.Fatalf("expected %s, got %s", name, v)
+		}
+		r.Close()
+		cleanup(t, s)
+	}
+
+	_, err := New(nil, map[string]interface{}{"key": []byte("testtesttesttesttesttesttesttesttest"),
+		"path": "test", "cipher": "rot13"})
+	if err == nil {
+		t.Fatal("expected an unknown cipher suite to be rejected")
+	}
+	os.RemoveAll("test")
 }
 
-func TestEncryptedKVPrefixIterator(t *testing.T) {
+func TestEncryptedKVBatchNamingAnotherKeyFailsCommitment(t *testing.T) {
 	s := open(t, nil)
-	defer cleanup(t, s)
-	test.CommonTestPrefixIterator(t, s)
+	defer os.RemoveAll("test")
+	err := s.(*Store).RotateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := s.Writer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := w.NewBatch()
+	b.Set([]byte("k"), []byte("v"))
+	err = w.ExecuteBatch(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// relabel the batch as sealed with the older data key
+	db, err := leveldb.OpenFile("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := make([]byte, binary.MaxVarintLen64)
+	binary.PutUvarint(seq, 1)
+	sealed, err := db.Get(seq, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint32(sealed, 1)
+	db.Put(seq, sealed, nil)
+	db.Close()
+
+	_, err = New(nil, map[string]interface{}{"key": []byte("testtesttesttesttesttesttesttesttest"),
+		"path": "test"})
+	if err != (ErrKeyCommitment{Seq: 1}) {
+		t.Fatalf("expected a key commitment failure on batch 1, got %v", err)
+	}
 }
 
-func TestEncryptedKVPrefixIteratorSeek(t *testing.T) {
+func TestEncryptedKVVerify(t *testing.T) {
 	s := open(t, nil)
-	defer cleanup(t, s)
-	test.CommonTestPrefixIteratorSeek(t, s)
+	defer os.RemoveAll("test")
+	for _, k := range []string{"a", "b", "c"} {
+		w, err := s.Writer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := w.NewBatch()
+		b.Set([]byte(k), []byte("v"))
+		err = w.ExecuteBatch(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+	}
+	report, err := s.(*Store).Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Batches != 3 {
+		t.Fatalf("expected 3 intact batches, got %d with faults %v", report.Batches, report.Faults)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// drop batch 1, flip a byte of batch 2 and name a missing data key in
+	// batch 3
+	db, err := leveldb.OpenFile("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batchKey := func(seq uint64) []byte {
+		k := make([]byte, binary.MaxVarintLen64)
+		binary.PutUvarint(k, seq)
+		return k
+	}
+	db.Delete(batchKey(1), nil)
+	sealed, err := db.Get(batchKey(2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed[len(sealed)-1] ^= 1
+	db.Put(batchKey(2), sealed, nil)
+	sealed, err = db.Get(batchKey(3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint32(sealed, 99)
+	db.Put(batchKey(3), sealed, nil)
+	db.Close()
+
+	report, err = Verify(map[string]interface{}{"key": []byte("testtesttesttesttesttesttesttesttest"),
+		"path": "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []BatchFault{{1, Truncated}, {2, Corrupt}, {3, WrongKey}}
+	if len(report.Faults) != len(expected) {
+		t.Fatalf("expected faults %v, got %v", expected, report.Faults)
+	}
+	for i, fault := range expected {
+		if report.Faults[i] != fault {
+			t.Fatalf("expected faults %v, got %v", expected, report.Faults)
+		}
+	}
 }
 
-func TestEncryptedKVRangeIterator(t *testing.T) {
+func TestEncryptedKVExecuteBatchReturnsWriteError(t *testing.T) {
 	s := open(t, nil)
-	defer cleanup(t, s)
-	test.CommonTestRangeIterator(t, s)
+	defer os.RemoveAll("test")
+	st := s.(*Store)
+	w, err := s.Writer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	st.db.Close()
+
+	b := w.NewBatch()
+	b.Set([]byte("k"), []byte("v"))
+	err = w.ExecuteBatch(b)
+	if err == nil {
+		t.Fatal("expected a failed write to be an error")
+	}
+	if st.seq != 0 {
+		t.Fatalf("expected the sequence not to advance, got %d", st.seq)
+	}
+	r, err := s.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	v, err := r.Get([]byte("k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != nil {
+		t.Fatalf("expected an unwritten batch to be invisible, got %s", v)
+	}
+	// a second batch still takes the lock
+	err = w.ExecuteBatch(b)
+	if err == nil {
+		t.Fatal("expected a failed write to be an error")
+	}
 }
 
-func TestEncryptedKVRangeIteratorSeek(t *testing.T) {
+func TestEncryptedKVRejectsRingWithoutSuite(t *testing.T) {
 	s := open(t, nil)
-	defer cleanup(t, s)
-	test.CommonTestRangeIteratorSeek(t, s)
-}
+	defer os.RemoveAll("test")
 
-func TestEncryptedKVMerge(t *testing.T) {
-	s := open(t, &test.TestMergeCounter{})
-	defer cleanup(t, s)
-	test.CommonTestMerge(t, s)
+	// save the ring with no cipher suite, which would mean unbound secretbox
+	// batches
+	st := s.(*Store)
+	rec := ringRecord{FirstSeq: st.firstSeq, Committed: true}
+	for id, key := range st.ring {
+		rec.Keys = append(rec.Keys, ringEntry{ID: id, Key: *key})
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nonce [nonceSize]byte
+	st.db.Put(ringKey, secretbox.Seal(nonce[:], buf.Bytes(), &nonce, st.key), nil)
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New(nil, map[string]interface{}{"key": []byte("testtesttesttesttesttesttesttesttest"),
+		"path": "test"})
+	if err == nil {
+		t.Fatal("expected a ring without a cipher suite to be rejected")
+	}
 }
@@ -0,0 +1,44 @@
+package encryptedkv
+
+import (
+	"encoding/binary"
+
+	"github.com/awans/fresnel/suite"
+)
+
+// loadSuite sets the cipher suite of a store without a key ring yet to
+// config["cipher"], or suite.Default, with batches that commit to their keys.
+// The ring records both once it is saved. A store with a ring has already
+// read them from it.
+func (s *Store) loadSuite(config map[string]interface{}) error {
+	if s.ring != nil {
+		return nil
+	}
+	s.suite = suite.Default
+	if name, ok := config["cipher"].(string); ok {
+		var err error
+		s.suite, err = suite.Parse(name)
+		if err != nil {
+			return err
+		}
+	}
+	s.committed = true
+	return nil
+}
+
+// commitSize is the size of each batch's key commitment, if it has one
+func (s *Store) commitSize() int {
+	if s.committed {
+		return suite.CommitmentSize
+	}
+	return 0
+}
+
+// batchAdditionalData binds a sealed batch to its sequence number and data
+// key, so batches cannot be swapped
+func batchAdditionalData(seq uint64, keyID uint32) []byte {
+	ad := make([]byte, 8+keyIDSize)
+	binary.BigEndian.PutUint64(ad, seq)
+	binary.BigEndian.PutUint32(ad[8:], keyID)
+	return ad
+}
@@ -0,0 +1,154 @@
+package encryptedkv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/awans/fresnel/keys"
+)
+
+// Fault is why a batch failed verification
+type Fault int
+
+// Faults
+const (
+	// Corrupt means the batch failed authentication or did not decode
+	Corrupt Fault = iota + 1
+	// Truncated means the batch is missing from the sequence or too short to
+	// name its data key
+	Truncated
+	// WrongKey means the batch names a data key the store does not have, or
+	// is not committed to the key it names
+	WrongKey
+)
+
+var faultNames = map[Fault]string{
+	Corrupt:   "corrupt",
+	Truncated: "truncated",
+	WrongKey:  "wrong key",
+}
+
+func (f Fault) String() string {
+	if name, ok := faultNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("fault %d", int(f))
+}
+
+// BatchFault is a batch that failed verification
+type BatchFault struct {
+	Seq   uint64
+	Fault Fault
+}
+
+func (b BatchFault) String() string {
+	return fmt.Sprintf("batch %d: %s", b.Seq, b.Fault)
+}
+
+// Report is what Verify found
+type Report struct {
+	Batches int64 // batches checked
+	Faults  []BatchFault
+}
+
+// OK reports whether every batch verified
+func (r *Report) OK() bool {
+	return len(r.Faults) == 0
+}
+
+// Verify decrypts and decodes every stored batch and reports each one that is
+// corrupt, missing or sealed with a key the store does not have. Writes wait
+// until it finishes. The error is only for failing to read the store at all.
+func (s *Store) Verify() (*Report, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	report := &Report{}
+	seen := make(map[uint64]bool)
+	iter := s.db.NewIterator(nil, nil)
+	for iter.Next() {
+		if isMetaKey(iter.Key()) {
+			continue
+		}
+		report.Batches++
+		seq, err := binary.ReadUvarint(bytes.NewReader(iter.Key()))
+		if err != nil {
+			report.Faults = append(report.Faults, BatchFault{Fault: Corrupt})
+			continue
+		}
+		seen[seq] = true
+		if fault := s.verifyBatch(seq, iter.Value()); fault != 0 {
+			report.Faults = append(report.Faults, BatchFault{Seq: seq, Fault: fault})
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	// batches are numbered from one without gaps
+	last := s.seq
+	for seq := range seen {
+		if seq > last {
+			last = seq
+		}
+	}
+	for seq := uint64(1); seq <= last; seq++ {
+		if !seen[seq] {
+			report.Faults = append(report.Faults, BatchFault{Seq: seq, Fault: Truncated})
+		}
+	}
+	sort.Slice(report.Faults, func(i, j int) bool { return report.Faults[i].Seq < report.Faults[j].Seq })
+	return report, nil
+}
+
+// Verify checks the store described by config as Store.Verify does, without
+// replaying its batches first, so a store too damaged to open can be checked.
+// The store is opened read-only.
+func Verify(config map[string]interface{}) (*Report, error) {
+	ro := map[string]interface{}{}
+	for k, v := range config {
+		ro[k] = v
+	}
+	ro["read_only"] = true
+	s, err := openStore(nil, ro, false)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	return s.Verify()
+}
+
+// verifyBatch checks a single stored batch, returning zero if it is intact
+func (s *Store) verifyBatch(seq uint64, sealed []byte) Fault {
+	if len(sealed) < keyIDSize {
+		return Truncated
+	}
+	batch, err := s.openRing(s.ring, seq, sealed)
+	if err != nil && (s.ring == nil || seq < s.firstSeq) {
+		// sealed directly with the store key, before the ring existed
+		batch, err = openBatch(s, seq, sealed)
+	}
+	if err == errNotInRing {
+		return WrongKey
+	}
+	if _, ok := err.(ErrKeyCommitment); ok {
+		return WrongKey
+	}
+	if err != nil {
+		return Corrupt
+	}
+	defer keys.Wipe(batch)
+	var items []Item
+	err = gob.NewDecoder(bytes.NewReader(batch)).Decode(&items)
+	for _, item := range items {
+		keys.Wipe(item.K)
+		keys.Wipe(item.V)
+	}
+	if err != nil && err != io.EOF {
+		return Corrupt
+	}
+	return 0
+}
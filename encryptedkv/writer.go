@@ -43,6 +43,7 @@ func (w *Writer) ExecuteBatch(batch store.KVBatch) error {
 		}
 		mergedVal, fullMergeOk := w.s.mo.FullMerge(kb, existingVal, mergeOps)
 		if !fullMergeOk {
+			w.s.writeLock.Unlock()
 			return fmt.Errorf("merge operator returned failure")
 		}
 		items = append(items, Item{K: kb, V: mergedVal})
@@ -51,15 +52,23 @@ func (w *Writer) ExecuteBatch(batch store.KVBatch) error {
 
 	for _, op := range emulatedBatch.Ops {
 		if op.V != nil {
-			items = append(items, Item{K: op.K, V: op.V})
-			t = t.Upsert(&Item{K: op.K, V: op.V}, rand.Int())
+			// the store keeps its own copies, which Close wipes
+			k := append([]byte(nil), op.K...)
+			v := append([]byte(nil), op.V...)
+			items = append(items, Item{K: k, V: v})
+			t = t.Upsert(&Item{K: k, V: v}, rand.Int())
 		} else {
 			items = append(items, Item{K: op.K, V: nil})
 			t = t.Delete(&Item{K: op.K})
 		}
 	}
 
-	writeBatchToFile(w.s, items)
+	err := writeBatchToFile(w.s, items)
+	if err != nil {
+		// the batch is not stored, so readers must not see it either
+		w.s.writeLock.Unlock()
+		return err
+	}
 	w.s.readLock.Lock()
 	w.s.treap = t
 	w.s.readLock.Unlock()
@@ -0,0 +1,117 @@
+// Package keys derives and manages the keys that fresnel's encrypted files
+// and stores are opened with.
+package keys
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Key derivation functions
+const (
+	// KDFNone means keys are used as is rather than derived
+	KDFNone uint8 = iota
+	KDFArgon2id
+	KDFScrypt
+)
+
+// Upper bounds on costs, so a tampered header cannot make opening a file
+// exhaust memory before the key can be checked
+const (
+	maxArgon2Memory = 4 << 20 // KiB
+	maxArgon2Time   = 64
+	maxScryptN      = 1 << 24
+	maxScryptMemory = 4 << 30 // bytes, 128·r·(N+p)
+)
+
+// KDFParams describe how a key is derived from a passphrase. The layout is
+// fixed size so it can be stored in binary headers.
+type KDFParams struct {
+	Algorithm uint8
+	// Threads is the Argon2id parallelism or the scrypt p parameter
+	Threads uint8
+	_       uint16
+	// Time is the number of Argon2id passes or the scrypt r parameter
+	Time uint32
+	// Memory is the Argon2id memory in KiB or the scrypt N parameter
+	Memory uint32
+	Salt   [16]byte
+}
+
+// NewKDFParams returns recommended costs for algorithm with a random salt
+func NewKDFParams(algorithm uint8) (KDFParams, error) {
+	p := KDFParams{Algorithm: algorithm}
+	switch algorithm {
+	case KDFArgon2id:
+		p.Time, p.Memory, p.Threads = 3, 64<<10, 4
+	case KDFScrypt:
+		p.Time, p.Memory, p.Threads = 8, 1<<15, 1
+	default:
+		return p, fmt.Errorf("unsupported key derivation function %d", algorithm)
+	}
+	_, err := io.ReadFull(rand.Reader, p.Salt[:])
+	return p, err
+}
+
+// Fill returns p with a random salt if it has none, or recommended Argon2id
+// parameters if it names no algorithm
+func (p KDFParams) Fill() (KDFParams, error) {
+	if p.Algorithm == KDFNone {
+		return NewKDFParams(KDFArgon2id)
+	}
+	if p.Salt == [16]byte{} {
+		_, err := io.ReadFull(rand.Reader, p.Salt[:])
+		if err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// Validate checks that the parameters describe a supported, bounded KDF
+func (p KDFParams) Validate() error {
+	switch p.Algorithm {
+	case KDFNone:
+		return nil
+	case KDFArgon2id:
+		if p.Time < 1 || p.Time > maxArgon2Time || p.Threads < 1 ||
+			p.Memory < 8*uint32(p.Threads) || p.Memory > maxArgon2Memory {
+			return fmt.Errorf("invalid argon2id parameters")
+		}
+	case KDFScrypt:
+		if p.Memory < 2 || p.Memory > maxScryptN || p.Memory&(p.Memory-1) != 0 ||
+			p.Time < 1 || p.Threads < 1 || uint64(p.Time)*uint64(p.Threads) >= 1<<30 ||
+			128*uint64(p.Time)*(uint64(p.Memory)+uint64(p.Threads)) > maxScryptMemory {
+			return fmt.Errorf("invalid scrypt parameters")
+		}
+	default:
+		return fmt.Errorf("unsupported key derivation function %d", p.Algorithm)
+	}
+	return nil
+}
+
+// DeriveKey stretches passphrase into a 32-byte key
+func DeriveKey(passphrase []byte, p KDFParams) ([32]byte, error) {
+	var key [32]byte
+	err := p.Validate()
+	if err != nil {
+		return key, err
+	}
+	switch p.Algorithm {
+	case KDFArgon2id:
+		copy(key[:], argon2.IDKey(passphrase, p.Salt[:], p.Time, p.Memory, p.Threads, 32))
+	case KDFScrypt:
+		k, err := scrypt.Key(passphrase, p.Salt[:], int(p.Memory), int(p.Time), int(p.Threads), 32)
+		if err != nil {
+			return key, err
+		}
+		copy(key[:], k)
+	default:
+		return key, fmt.Errorf("no key derivation function")
+	}
+	return key, nil
+}
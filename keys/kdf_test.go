@@ -0,0 +1,67 @@
+package keys
+
+import "testing"
+
+func TestDeriveKey(t *testing.T) {
+	for _, algorithm := range []uint8{KDFArgon2id, KDFScrypt} {
+		p, err := NewKDFParams(algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// keep the test fast
+		if algorithm == KDFArgon2id {
+			p.Time, p.Memory, p.Threads = 1, 64, 1
+		} else {
+			p.Memory = 1 << 10
+		}
+
+		a, err := DeriveKey([]byte("correct horse"), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := DeriveKey([]byte("correct horse"), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a != b {
+			t.Fatal("expected the same passphrase and salt to derive the same key")
+		}
+		c, err := DeriveKey([]byte("battery staple"), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a == c {
+			t.Fatal("expected different passphrases to derive different keys")
+		}
+		p.Salt[0] ^= 0xff
+		d, err := DeriveKey([]byte("correct horse"), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a == d {
+			t.Fatal("expected different salts to derive different keys")
+		}
+	}
+}
+
+func TestValidateRejectsExcessiveCost(t *testing.T) {
+	p := KDFParams{Algorithm: KDFArgon2id, Time: 1, Threads: 1, Memory: 1 << 30}
+	if p.Validate() == nil {
+		t.Fatal("expected excessive memory to be rejected")
+	}
+	p = KDFParams{Algorithm: KDFScrypt, Time: 8, Threads: 1, Memory: 1000}
+	if p.Validate() == nil {
+		t.Fatal("expected non power of two N to be rejected")
+	}
+	p = KDFParams{Algorithm: KDFScrypt, Time: 1 << 20, Threads: 1, Memory: 1 << 24}
+	if p.Validate() == nil {
+		t.Fatal("expected excessive scrypt r to be rejected")
+	}
+	p, err := NewKDFParams(KDFScrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Validate() != nil {
+		t.Fatal("expected recommended scrypt parameters to be accepted")
+	}
+}
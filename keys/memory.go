@@ -0,0 +1,54 @@
+package keys
+
+import (
+	"runtime"
+	"unsafe"
+)
+
+// Memory holds key material outside the Go heap, where the garbage collector
+// never copies it. Where the platform allows, it is also locked so it is
+// never written to swap, and excluded from core dumps. Free wipes it.
+type Memory struct {
+	b      []byte
+	locked bool
+}
+
+// NewMemory allocates room for n keys
+func NewMemory(n int) (*Memory, error) {
+	b, locked, err := allocMemory(n * 32)
+	if err != nil {
+		return nil, err
+	}
+	return &Memory{b: b[:n*32], locked: locked}, nil
+}
+
+// Key returns the i'th key slot
+func (m *Memory) Key(i int) *[32]byte {
+	return (*[32]byte)(unsafe.Pointer(&m.b[i*32]))
+}
+
+// Locked reports whether the memory is locked against swapping. Locking can
+// fail when the process is over its limit of locked memory, in which case
+// the keys are still kept off the heap and wiped.
+func (m *Memory) Locked() bool {
+	return m.locked
+}
+
+// Free wipes and releases the memory. No key from it may be used afterwards.
+func (m *Memory) Free() error {
+	if m.b == nil {
+		return nil
+	}
+	Wipe(m.b)
+	b := m.b
+	m.b = nil
+	return freeMemory(b[:cap(b)], m.locked)
+}
+
+// Wipe overwrites b with zeros
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	runtime.KeepAlive(b)
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package keys
+
+// Without mmap the keys live on the heap, unlocked, but are still wiped
+func allocMemory(size int) ([]byte, bool, error) {
+	return make([]byte, size), false, nil
+}
+
+func freeMemory(b []byte, locked bool) error {
+	return nil
+}
@@ -0,0 +1,21 @@
+package keys
+
+import "testing"
+
+func TestMemory(t *testing.T) {
+	m, err := NewMemory(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*m.Key(1) = testKey
+	if *m.Key(1) != testKey || *m.Key(0) != ([32]byte{}) {
+		t.Fatal("expected key slots to be independent")
+	}
+	err = m.Free()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.b != nil {
+		t.Fatal("expected freed memory to be released")
+	}
+}
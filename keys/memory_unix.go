@@ -0,0 +1,28 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package keys
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func allocMemory(size int) ([]byte, bool, error) {
+	pageSize := os.Getpagesize()
+	size = (size + pageSize - 1) / pageSize * pageSize
+	b, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, false, err
+	}
+	excludeFromDumps(b)
+	return b, unix.Mlock(b) == nil, nil
+}
+
+func freeMemory(b []byte, locked bool) error {
+	if locked {
+		unix.Munlock(b)
+	}
+	return unix.Munmap(b)
+}
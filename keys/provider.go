@@ -0,0 +1,250 @@
+package keys
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// ErrNoPassphrase is returned when a passphrase is given for a file or store
+// that was created with a raw key and never given one
+var ErrNoPassphrase = errors.New("no passphrase has been set")
+
+// KeyProvider supplies the key-encryption key a file or store is opened
+// with. Stores ask for the key when they are opened, and again when asked to
+// refresh it, so a provider can hand out a new key to rotate to.
+type KeyProvider interface {
+	// Key returns the key-encryption key. params are the key derivation
+	// parameters of the file or store being opened; providers of raw keys
+	// ignore them.
+	Key(params KDFParams) ([32]byte, error)
+}
+
+// KeyFunc adapts a function to a KeyProvider
+type KeyFunc func(params KDFParams) ([32]byte, error)
+
+// Key calls fn
+func (fn KeyFunc) Key(params KDFParams) ([32]byte, error) {
+	return fn(params)
+}
+
+// MarshalJSON writes null. Store configs may be persisted, as bleve does in
+// index_meta.json, so providers supply them at runtime rather than being
+// saved with them.
+func (fn KeyFunc) MarshalJSON() ([]byte, error) {
+	return []byte("null"), nil
+}
+
+// NewKey asks p for the key of a new file or store. p is asked first without
+// key derivation parameters: a provider that derives its key from a
+// passphrase refuses with ErrNoPassphrase and is asked again with params
+// filled in. It returns the parameters the key was derived with, which are
+// zero for a raw key and so need not be recorded.
+func NewKey(p KeyProvider, params KDFParams) ([32]byte, KDFParams, error) {
+	key, err := p.Key(KDFParams{})
+	if err != ErrNoPassphrase {
+		return key, KDFParams{}, err
+	}
+	params, err = params.Fill()
+	if err != nil {
+		return key, params, err
+	}
+	key, err = p.Key(params)
+	return key, params, err
+}
+
+// StaticKey always provides key
+func StaticKey(key [32]byte) KeyProvider {
+	return KeyFunc(func(KDFParams) ([32]byte, error) {
+		return key, nil
+	})
+}
+
+// Passphrase derives the key from passphrase
+func Passphrase(passphrase []byte) KeyProvider {
+	return passphraseFunc(func() ([]byte, error) {
+		return passphrase, nil
+	})
+}
+
+// Prompt asks for a passphrase on the terminal, without echoing it, each time
+// a key is needed
+func Prompt(prompt string) KeyProvider {
+	return passphraseFunc(func() ([]byte, error) {
+		tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer tty.Close()
+		fmt.Fprint(tty, prompt)
+		passphrase, err := term.ReadPassword(int(tty.Fd()))
+		fmt.Fprintln(tty)
+		return passphrase, err
+	})
+}
+
+func passphraseFunc(get func() ([]byte, error)) KeyProvider {
+	return KeyFunc(func(params KDFParams) ([32]byte, error) {
+		if params.Algorithm == KDFNone {
+			return [32]byte{}, ErrNoPassphrase
+		}
+		passphrase, err := get()
+		if err != nil {
+			return [32]byte{}, err
+		}
+		return DeriveKey(passphrase, params)
+	})
+}
+
+// KeyFile reads the key from a file holding either 32 raw bytes or 64 hex
+// digits
+func KeyFile(path string) KeyProvider {
+	return KeyFunc(func(KDFParams) ([32]byte, error) {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return [32]byte{}, err
+		}
+		if len(b) == 32 {
+			var key [32]byte
+			copy(key[:], b)
+			return key, nil
+		}
+		return ParseKey(string(bytes.TrimSpace(b)))
+	})
+}
+
+// EnvKey reads the key as 64 hex digits from the environment variable name
+func EnvKey(name string) KeyProvider {
+	return KeyFunc(func(KDFParams) ([32]byte, error) {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return [32]byte{}, fmt.Errorf("%s is not set", name)
+		}
+		return ParseKey(v)
+	})
+}
+
+// ParseKey decodes a key written as 64 hex digits
+func ParseKey(s string) ([32]byte, error) {
+	var key [32]byte
+	b, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != len(key) {
+		return key, errors.New("key must be 64 hex digits")
+	}
+	copy(key[:], b)
+	return key, nil
+}
+
+// SocketKey asks the key server listening on the unix socket at path for the
+// key named id. See ServeKeys for the protocol.
+func SocketKey(path string, id string) KeyProvider {
+	return KeyFunc(func(KDFParams) ([32]byte, error) {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			return [32]byte{}, err
+		}
+		defer conn.Close()
+		_, err = fmt.Fprintf(conn, "KEY %s\n", id)
+		if err != nil {
+			return [32]byte{}, err
+		}
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return [32]byte{}, err
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "ERR ") {
+			return [32]byte{}, fmt.Errorf("key server: %s", line[len("ERR "):])
+		}
+		if !strings.HasPrefix(line, "OK ") {
+			return [32]byte{}, errors.New("key server: malformed response")
+		}
+		return ParseKey(line[len("OK "):])
+	})
+}
+
+// ServeKeys is a stand-in for a key management service. For each connection
+// accepted on l it reads a request line "KEY <id>" and answers "OK <hex key>"
+// with the key lookup returns, or "ERR <message>". It returns when l is
+// closed.
+func ServeKeys(l net.Listener, lookup func(id string) ([32]byte, error)) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveKey(conn, lookup)
+	}
+}
+
+func serveKey(conn net.Conn, lookup func(id string) ([32]byte, error)) {
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 2 || fields[0] != "KEY" {
+		fmt.Fprintf(conn, "ERR malformed request\n")
+		return
+	}
+	key, err := lookup(fields[1])
+	if err != nil {
+		fmt.Fprintf(conn, "ERR %s\n", strings.Replace(err.Error(), "\n", " ", -1))
+		return
+	}
+	fmt.Fprintf(conn, "OK %s\n", hex.EncodeToString(key[:]))
+}
+
+// FromConfig returns the key provider named by a store config: a KeyProvider
+// under "key_provider", a key-encryption key under "key", a passphrase under
+// "passphrase", or Split shares of a key under "key_shares". Only the first
+// 32 bytes of a longer key are used.
+func FromConfig(config map[string]interface{}) (KeyProvider, error) {
+	if p, ok := config["key_provider"].(KeyProvider); ok {
+		return p, nil
+	}
+	if in, ok := config["key"].([]byte); ok {
+		if len(in) < 32 {
+			return nil, fmt.Errorf("key must be at least 32 bytes, got %d", len(in))
+		}
+		var key [32]byte
+		copy(key[:], in)
+		return StaticKey(key), nil
+	}
+	if passphrase, ok := config["passphrase"].(string); ok {
+		return Passphrase([]byte(passphrase)), nil
+	}
+	if shares, ok := config["key_shares"].([][]byte); ok {
+		return Shares(shares), nil
+	}
+	return nil, errors.New("must provide key_provider, [32]byte key, passphrase or key_shares")
+}
+
+// FromEnv returns the key provider the command line tools use: the key file
+// named by FRESNEL_KEY_FILE, the file of shares named by FRESNEL_KEY_SHARES,
+// the hex key in FRESNEL_KEY, the passphrase in FRESNEL_PASSPHRASE or,
+// failing those, a passphrase prompt
+func FromEnv() KeyProvider {
+	if path := os.Getenv("FRESNEL_KEY_FILE"); path != "" {
+		return KeyFile(path)
+	}
+	if path := os.Getenv("FRESNEL_KEY_SHARES"); path != "" {
+		return ShareFile(path)
+	}
+	if _, ok := os.LookupEnv("FRESNEL_KEY"); ok {
+		return EnvKey("FRESNEL_KEY")
+	}
+	if passphrase, ok := os.LookupEnv("FRESNEL_PASSPHRASE"); ok {
+		return Passphrase([]byte(passphrase))
+	}
+	return Prompt("Passphrase: ")
+}
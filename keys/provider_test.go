@@ -0,0 +1,141 @@
+package keys
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testKey = [32]byte{'t', 'e', 's', 't'}
+
+func TestKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	raw := filepath.Join(dir, "raw")
+	err = ioutil.WriteFile(raw, testKey[:], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := filepath.Join(dir, "hex")
+	err = ioutil.WriteFile(encoded, []byte(hex.EncodeToString(testKey[:])+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{raw, encoded} {
+		key, err := KeyFile(path).Key(KDFParams{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != testKey {
+			t.Fatalf("wrong key read from %s", path)
+		}
+	}
+}
+
+func TestEnvKey(t *testing.T) {
+	os.Setenv("FRESNEL_TEST_KEY", hex.EncodeToString(testKey[:]))
+	defer os.Unsetenv("FRESNEL_TEST_KEY")
+	key, err := EnvKey("FRESNEL_TEST_KEY").Key(KDFParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != testKey {
+		t.Fatal("wrong key read from the environment")
+	}
+	_, err = EnvKey("FRESNEL_TEST_UNSET").Key(KDFParams{})
+	if err == nil {
+		t.Fatal("expected an unset variable to fail")
+	}
+}
+
+func TestSocketKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kms.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go ServeKeys(l, func(id string) ([32]byte, error) {
+		if id != "tenant-1" {
+			return [32]byte{}, errors.New("unknown key")
+		}
+		return testKey, nil
+	})
+
+	key, err := SocketKey(path, "tenant-1").Key(KDFParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != testKey {
+		t.Fatal("wrong key from the key server")
+	}
+	_, err = SocketKey(path, "tenant-2").Key(KDFParams{})
+	if err == nil {
+		t.Fatal("expected an unknown key to fail")
+	}
+}
+
+func TestPassphraseNeedsParameters(t *testing.T) {
+	_, err := Passphrase([]byte("correct horse")).Key(KDFParams{})
+	if err != ErrNoPassphrase {
+		t.Fatalf("expected ErrNoPassphrase, got %v", err)
+	}
+}
+
+func TestNewKeyOnlyFillsParametersForPassphrases(t *testing.T) {
+	key := [32]byte{1}
+	got, params, err := NewKey(StaticKey(key), KDFParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != key || params != (KDFParams{}) {
+		t.Fatal("expected the raw key with no parameters")
+	}
+
+	cheap := KDFParams{Algorithm: KDFArgon2id, Time: 1, Memory: 64, Threads: 1}
+	got, params, err = NewKey(Passphrase([]byte("correct horse")), cheap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Algorithm != KDFArgon2id || params.Salt == [16]byte{} {
+		t.Fatal("expected filled Argon2id parameters")
+	}
+	want, err := DeriveKey([]byte("correct horse"), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatal("expected the key derived with the returned parameters")
+	}
+}
+
+func TestFromConfigRejectsShortKey(t *testing.T) {
+	_, err := FromConfig(map[string]interface{}{"key": []byte("short")})
+	if err == nil {
+		t.Fatal("expected a short key to be rejected")
+	}
+}
+
+func TestProvidersAreNotPersisted(t *testing.T) {
+	b, err := json.Marshal(map[string]interface{}{"key_provider": StaticKey(testKey)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"key_provider":null}` {
+		t.Fatalf("expected the provider to marshal to null, got %s", b)
+	}
+}
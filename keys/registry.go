@@ -0,0 +1,217 @@
+package keys
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ErrRevoked is returned for the key of a tenant that has been revoked
+var ErrRevoked = errors.New("tenant key has been revoked")
+
+// ErrWrongMasterKey is returned when a registry is opened with a different
+// master key than it was created with
+var ErrWrongMasterKey = errors.New("wrong master key")
+
+// Registry holds a random key for each tenant, wrapped under a master key.
+// Tenant keys are never derived from the master key, so revoking a tenant
+// destroys its only copy and leaves every file, batch and backup of its data
+// permanently unreadable. The registry must therefore be kept out of the
+// backups of the data it protects.
+type Registry struct {
+	path   string
+	master [32]byte
+	file   registryFile
+	m      sync.Mutex
+}
+
+// TenantInfo describes one tenant in a registry
+type TenantInfo struct {
+	ID      string
+	Created time.Time
+	Revoked time.Time // zero while the key exists
+}
+
+type registryFile struct {
+	KDF      KDFParams
+	KeyCheck []byte
+	Tenants  map[string]*tenantEntry
+}
+
+type tenantEntry struct {
+	Created time.Time
+	Revoked time.Time
+	Nonce   []byte
+	Sealed  []byte
+}
+
+// OpenRegistry opens or creates the tenant key registry at path, unlocking it
+// with the key from master. A passphrase master is stretched with parameters
+// recorded in the registry.
+func OpenRegistry(path string, master KeyProvider) (*Registry, error) {
+	r := &Registry{path: path}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		r.file.KDF, err = NewKDFParams(KDFArgon2id)
+		if err != nil {
+			return nil, err
+		}
+		r.file.Tenants = make(map[string]*tenantEntry)
+		r.master, err = master.Key(r.file.KDF)
+		if err != nil {
+			return nil, err
+		}
+		r.file.KeyCheck = r.keyCheck()
+		return r, r.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = gob.NewDecoder(bytes.NewReader(b)).Decode(&r.file)
+	if err != nil {
+		return nil, err
+	}
+	if r.file.Tenants == nil {
+		r.file.Tenants = make(map[string]*tenantEntry)
+	}
+	r.master, err = master.Key(r.file.KDF)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(r.file.KeyCheck, r.keyCheck()) {
+		return nil, ErrWrongMasterKey
+	}
+	return r, nil
+}
+
+func (r *Registry) keyCheck() []byte {
+	mac := hmac.New(sha256.New, r.master[:])
+	mac.Write([]byte("fresnel registry key check"))
+	return mac.Sum(nil)
+}
+
+// Provider provides the key of tenant, creating one the first time it is
+// asked for
+func (r *Registry) Provider(tenant string) KeyProvider {
+	return KeyFunc(func(KDFParams) ([32]byte, error) {
+		return r.tenantKey(tenant)
+	})
+}
+
+func (r *Registry) tenantKey(tenant string) ([32]byte, error) {
+	var key [32]byte
+	r.m.Lock()
+	defer r.m.Unlock()
+	aead, err := chacha20poly1305.NewX(r.master[:])
+	if err != nil {
+		return key, err
+	}
+	e, ok := r.file.Tenants[tenant]
+	if ok {
+		if !e.Revoked.IsZero() {
+			return key, ErrRevoked
+		}
+		out, err := aead.Open(key[:0], e.Nonce, e.Sealed, []byte(tenant))
+		if err != nil || len(out) != len(key) {
+			return key, errors.New("tenant key failed authentication")
+		}
+		return key, nil
+	}
+
+	_, err = io.ReadFull(rand.Reader, key[:])
+	if err != nil {
+		return key, err
+	}
+	e = &tenantEntry{Created: time.Now().UTC(), Nonce: make([]byte, aead.NonceSize())}
+	_, err = io.ReadFull(rand.Reader, e.Nonce)
+	if err != nil {
+		return key, err
+	}
+	e.Sealed = aead.Seal(nil, e.Nonce, key[:], []byte(tenant))
+	r.file.Tenants[tenant] = e
+	err = r.save()
+	if err != nil {
+		delete(r.file.Tenants, tenant)
+	}
+	return key, err
+}
+
+// Tenants lists every tenant in the registry, including revoked ones
+func (r *Registry) Tenants() []TenantInfo {
+	r.m.Lock()
+	defer r.m.Unlock()
+	var rv []TenantInfo
+	for id, e := range r.file.Tenants {
+		rv = append(rv, TenantInfo{ID: id, Created: e.Created, Revoked: e.Revoked})
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].ID < rv[j].ID })
+	return rv
+}
+
+// Revoked reports whether tenant's key has been revoked
+func (r *Registry) Revoked(tenant string) bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	e, ok := r.file.Tenants[tenant]
+	return ok && !e.Revoked.IsZero()
+}
+
+// Revoke destroys tenant's key. The tenant is remembered as revoked, so it is
+// not silently given a new key.
+func (r *Registry) Revoke(tenant string) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	e, ok := r.file.Tenants[tenant]
+	if !ok {
+		return errors.New("unknown tenant")
+	}
+	if !e.Revoked.IsZero() {
+		return nil
+	}
+	old := *e
+	e.Revoked = time.Now().UTC()
+	e.Nonce, e.Sealed = nil, nil
+	err := r.save()
+	if err != nil {
+		*e = old
+	}
+	return err
+}
+
+// save replaces the registry file, so a crash leaves either the old or the
+// new one
+func (r *Registry) save() error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&r.file)
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
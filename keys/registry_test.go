@@ -0,0 +1,67 @@
+package keys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registry")
+
+	r, err := OpenRegistry(path, StaticKey(testKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	one, err := r.Provider("1").Key(KDFParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	two, err := r.Provider("2").Key(KDFParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if one == two {
+		t.Fatal("expected tenants to get distinct keys")
+	}
+
+	_, err = OpenRegistry(path, StaticKey([32]byte{'o', 't', 'h', 'e', 'r'}))
+	if err != ErrWrongMasterKey {
+		t.Fatalf("expected ErrWrongMasterKey, got %v", err)
+	}
+	r, err = OpenRegistry(path, StaticKey(testKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := r.Provider("1").Key(KDFParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != one {
+		t.Fatal("expected the tenant key to be persisted")
+	}
+
+	err = r.Revoke("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = OpenRegistry(path, StaticKey(testKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Provider("1").Key(KDFParams{})
+	if err != ErrRevoked {
+		t.Fatalf("expected ErrRevoked, got %v", err)
+	}
+	tenants := r.Tenants()
+	if len(tenants) != 2 || tenants[0].ID != "1" || tenants[0].Revoked.IsZero() ||
+		!tenants[1].Revoked.IsZero() {
+		t.Fatalf("unexpected tenants %v", tenants)
+	}
+}
@@ -0,0 +1,184 @@
+package keys
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Arithmetic in GF(2^8) with the AES polynomial. Shares and secrets pass
+// through it, so it runs in constant time: no table lookups or branches
+// depend on the operands.
+
+func gfMul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		// add a if the low bit of b is set, then multiply a by x
+		p ^= a & -(b & 1)
+		a = a<<1 ^ 0x1b&-(a>>7)
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns a^254, which is the inverse of a for nonzero a, and zero
+// for zero
+func gfInv(a byte) byte {
+	a2 := gfMul(a, a)
+	a4 := gfMul(a2, a2)
+	a8 := gfMul(a4, a4)
+	a16 := gfMul(a8, a8)
+	a32 := gfMul(a16, a16)
+	a64 := gfMul(a32, a32)
+	a128 := gfMul(a64, a64)
+	return gfMul(gfMul(gfMul(gfMul(gfMul(gfMul(a128, a64), a32), a16), a8), a4), a2)
+}
+
+func gfDiv(a, b byte) byte {
+	return gfMul(a, gfInv(b))
+}
+
+// Split divides secret into n shares, any k of which recover it with
+// Combine and fewer than k of which reveal nothing about it. Each share is
+// its x coordinate followed by one byte per byte of secret.
+func Split(secret []byte, n, k int) ([][]byte, error) {
+	if k < 2 || n < k || n > 255 {
+		return nil, fmt.Errorf("cannot split into %d shares with a threshold of %d", n, k)
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("cannot split an empty secret")
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][0] = byte(i + 1)
+	}
+	coeffs := make([]byte, k)
+	for j, s := range secret {
+		coeffs[0] = s
+		_, err := io.ReadFull(rand.Reader, coeffs[1:])
+		if err != nil {
+			return nil, err
+		}
+		for _, share := range shares {
+			// evaluate the polynomial at x with Horner's rule
+			x, y := share[0], byte(0)
+			for c := k - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coeffs[c]
+			}
+			share[j+1] = y
+		}
+	}
+	for i := range coeffs {
+		coeffs[i] = 0
+	}
+	return shares, nil
+}
+
+// Combine recovers a secret from at least the threshold number of its shares.
+// Too few shares combine to the wrong secret rather than failing.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least two shares are needed")
+	}
+	size := len(shares[0])
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if len(share) != size || size < 2 {
+			return nil, errors.New("shares have different lengths")
+		}
+		if share[0] == 0 || seen[share[0]] {
+			return nil, errors.New("duplicate or invalid share")
+		}
+		seen[share[0]] = true
+	}
+	secret := make([]byte, size-1)
+	for j := range secret {
+		// Lagrange interpolation at x = 0
+		var y byte
+		for i, si := range shares {
+			basis := byte(1)
+			for m, sm := range shares {
+				if i != m {
+					basis = gfMul(basis, gfDiv(sm[0], sm[0]^si[0]))
+				}
+			}
+			y ^= gfMul(si[j+1], basis)
+		}
+		secret[j] = y
+	}
+	return secret, nil
+}
+
+// EncodeShare writes a share as hex digits
+func EncodeShare(share []byte) string {
+	return hex.EncodeToString(share)
+}
+
+// DecodeShare parses a share written by EncodeShare
+func DecodeShare(s string) ([]byte, error) {
+	share, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(share) < 2 {
+		return nil, errors.New("malformed share")
+	}
+	return share, nil
+}
+
+// Shares provides the key combined from shares split from it
+func Shares(shares [][]byte) KeyProvider {
+	return KeyFunc(func(KDFParams) ([32]byte, error) {
+		return combineKey(shares)
+	})
+}
+
+// ShareFile provides the key combined from the shares in a file, one
+// EncodeShare line per share holder
+func ShareFile(path string) KeyProvider {
+	return KeyFunc(func(KDFParams) ([32]byte, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return [32]byte{}, err
+		}
+		defer f.Close()
+		shares, err := ReadShares(f)
+		if err != nil {
+			return [32]byte{}, err
+		}
+		return combineKey(shares)
+	})
+}
+
+// ReadShares reads EncodeShare lines, ignoring blank ones
+func ReadShares(r io.Reader) ([][]byte, error) {
+	var shares [][]byte
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		share, err := DecodeShare(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, scanner.Err()
+}
+
+func combineKey(shares [][]byte) ([32]byte, error) {
+	var key [32]byte
+	secret, err := Combine(shares)
+	if err != nil {
+		return key, err
+	}
+	if len(secret) != len(key) {
+		return key, errors.New("shares are not of a 32-byte key")
+	}
+	copy(key[:], secret)
+	return key, nil
+}
@@ -0,0 +1,88 @@
+package keys
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGFArithmetic(t *testing.T) {
+	// from FIPS 197, section 4.2
+	if gfMul(0x57, 0x83) != 0xc1 || gfMul(0x57, 0x13) != 0xfe {
+		t.Fatal("wrong product")
+	}
+	if gfInv(0) != 0 {
+		t.Fatal("expected zero to have no inverse")
+	}
+	for a := 1; a < 256; a++ {
+		if gfMul(byte(a), gfInv(byte(a))) != 1 {
+			t.Fatalf("wrong inverse of %#x", a)
+		}
+		for b := 1; b < 256; b++ {
+			if gfDiv(gfMul(byte(a), byte(b)), byte(b)) != byte(a) {
+				t.Fatalf("%#x * %#x / %#x != %#x", a, b, b, a)
+			}
+		}
+	}
+}
+
+func TestSplitCombine(t *testing.T) {
+	shares, err := Split(testKey[:], 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		var chosen [][]byte
+		for _, i := range subset {
+			chosen = append(chosen, shares[i])
+		}
+		secret, err := Combine(chosen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(secret, testKey[:]) {
+			t.Fatalf("shares %v did not recover the secret", subset)
+		}
+	}
+	secret, err := Combine(shares[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(secret, testKey[:]) {
+		t.Fatal("expected fewer than the threshold not to recover the secret")
+	}
+	_, err = Combine([][]byte{shares[0], shares[0]})
+	if err == nil {
+		t.Fatal("expected duplicate shares to be rejected")
+	}
+}
+
+func TestSharesProvider(t *testing.T) {
+	shares, err := Split(testKey[:], 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encoded bytes.Buffer
+	for _, share := range shares[1:] {
+		encoded.WriteString(EncodeShare(share) + "\n")
+	}
+	read, err := ReadShares(&encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := Shares(read).Key(KDFParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != testKey {
+		t.Fatal("wrong key combined from shares")
+	}
+}
+
+func TestSplitRejectsBadThreshold(t *testing.T) {
+	for _, nk := range [][2]int{{3, 1}, {2, 3}, {256, 2}} {
+		_, err := Split(testKey[:], nk[0], nk[1])
+		if err == nil {
+			t.Fatalf("expected %d shares with threshold %d to be rejected", nk[0], nk[1])
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package keys
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// TenantKey derives the key for one of a tenant's files from a master key
+// with HKDF-SHA256. Each tenant's data is cryptographically isolated while
+// operators manage a single master secret. role distinguishes the files of
+// one tenant, such as its ekv and encryptedkv stores.
+func TenantKey(master [32]byte, tenant string, role string) ([32]byte, error) {
+	var key [32]byte
+	// length prefixes keep distinct (tenant, role) pairs from colliding
+	info := []byte("fresnel tenant key")
+	for _, s := range []string{tenant, role} {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(s)))
+		info = append(info, n[:]...)
+		info = append(info, s...)
+	}
+	_, err := io.ReadFull(hkdf.New(sha256.New, master[:], nil, info), key[:])
+	return key, err
+}
+
+// Tenant provides tenant keys derived from the master keys master provides
+func Tenant(master KeyProvider, tenant string, role string) KeyProvider {
+	return KeyFunc(func(params KDFParams) ([32]byte, error) {
+		key, err := master.Key(params)
+		if err != nil {
+			return key, err
+		}
+		return TenantKey(key, tenant, role)
+	})
+}
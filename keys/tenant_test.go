@@ -0,0 +1,29 @@
+package keys
+
+import "testing"
+
+func TestTenantKey(t *testing.T) {
+	a, err := TenantKey(testKey, "1", "ekv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := TenantKey(testKey, "1", "ekv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != again {
+		t.Fatal("expected tenant keys to be deterministic")
+	}
+	if a == testKey {
+		t.Fatal("expected the tenant key to differ from the master key")
+	}
+	for _, other := range [][2]string{{"2", "ekv"}, {"1", "encryptedkv"}, {"1e", "kv"}} {
+		b, err := TenantKey(testKey, other[0], other[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a == b {
+			t.Fatalf("expected tenant %q role %q to get its own key", other[0], other[1])
+		}
+	}
+}
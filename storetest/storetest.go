@@ -0,0 +1,339 @@
+// Package storetest holds the tests that every encrypted bleve KV store in
+// fresnel must pass, whatever its backend. Each store package runs them from
+// its own tests with Run.
+package storetest
+
+import (
+	"os"
+	"testing"
+
+	"github.com/awans/fresnel/keys"
+	"github.com/blevesearch/bleve/index/store"
+	"github.com/blevesearch/bleve/index/store/test"
+)
+
+// Path is where the stores under test are created, relative to the working
+// directory
+const Path = "test"
+
+var testKey = []byte("testtesttesttesttesttesttesttesttest")
+
+// Backend describes a store implementation to test
+type Backend struct {
+	// New opens the store described by config
+	New func(mo store.MergeOperator, config map[string]interface{}) (store.KVStore, error)
+	// Verify checks the store described by config, reporting whether it is
+	// intact
+	Verify func(config map[string]interface{}) (bool, error)
+	// the errors the implementation returns for a wrong key, a passphrase
+	// for a store without one, and a write to a read-only store
+	ErrWrongKey     error
+	ErrNoPassphrase error
+	ErrReadOnly     error
+}
+
+// keyStore is the key management every store offers
+type keyStore interface {
+	AddKey(kek [32]byte) error
+	RemoveKey(kek [32]byte) error
+	RefreshKey() error
+	RotateDataKey() error
+	RetireDataKeys() error
+}
+
+// Run runs the shared tests against b, each as a subtest
+func Run(t *testing.T, b Backend) {
+	for _, tc := range []struct {
+		name string
+		fn   func(t *testing.T, b Backend)
+	}{
+		{"KVCrud", common(test.CommonTestKVCrud, nil)},
+		{"ReaderIsolation", common(test.CommonTestReaderIsolation, nil)},
+		{"ReaderOwnsGetBytes", common(test.CommonTestReaderOwnsGetBytes, nil)},
+		{"WriterOwnsBytes", common(test.CommonTestWriterOwnsBytes, nil)},
+		{"PrefixIterator", common(test.CommonTestPrefixIterator, nil)},
+		{"PrefixIteratorSeek", common(test.CommonTestPrefixIteratorSeek, nil)},
+		{"RangeIterator", common(test.CommonTestRangeIterator, nil)},
+		{"RangeIteratorSeek", common(test.CommonTestRangeIteratorSeek, nil)},
+		{"Merge", common(test.CommonTestMerge, &test.TestMergeCounter{})},
+		{"WrongKey", testWrongKey},
+		{"AddRemoveKey", testAddRemoveKey},
+		{"Passphrase", testPassphrase},
+		{"RawKeyRejectsPassphrase", testRawKeyRejectsPassphrase},
+		{"ShortKey", testShortKey},
+		{"RefreshKey", testRefreshKey},
+		{"TenantsHaveDistinctKeys", testTenantsHaveDistinctKeys},
+		{"OpenFromShares", testOpenFromShares},
+		{"RotateDataKey", testRotateDataKey},
+		{"Verify", testVerify},
+		{"ReadOnly", testReadOnly},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			defer os.RemoveAll(Path)
+			tc.fn(t, b)
+		})
+	}
+}
+
+// Open opens a store at Path under the test key
+func Open(t *testing.T, b Backend, mo store.MergeOperator) store.KVStore {
+	s, err := b.New(mo, map[string]interface{}{"key": testKey, "path": Path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Set writes k=v to s in a batch of its own
+func Set(t *testing.T, s store.KVStore, k, v string) {
+	w, err := s.Writer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	batch := w.NewBatch()
+	batch.Set([]byte(k), []byte(v))
+	err = w.ExecuteBatch(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func closeStore(t *testing.T, s store.KVStore) {
+	err := s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reopen checks that config opens the store at Path
+func reopen(t *testing.T, b Backend, config map[string]interface{}) {
+	s, err := b.New(nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeStore(t, s)
+}
+
+func common(fn func(t *testing.T, s store.KVStore), mo store.MergeOperator) func(*testing.T, Backend) {
+	return func(t *testing.T, b Backend) {
+		s := Open(t, b, mo)
+		defer closeStore(t, s)
+		fn(t, s)
+	}
+}
+
+func testWrongKey(t *testing.T, b Backend) {
+	closeStore(t, Open(t, b, nil))
+
+	_, err := b.New(nil, map[string]interface{}{"key": []byte("wrongwrongwrongwrongwrongwrongwrong"),
+		"path": Path})
+	if err != b.ErrWrongKey {
+		t.Fatalf("expected ErrWrongKey, got %v", err)
+	}
+}
+
+func testAddRemoveKey(t *testing.T, b Backend) {
+	s := Open(t, b, nil)
+	otherKey := [32]byte{'o', 't', 'h', 'e', 'r'}
+	err := s.(keyStore).AddKey(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var k [32]byte
+	copy(k[:], testKey)
+	err = s.(keyStore).RemoveKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeStore(t, s)
+
+	_, err = b.New(nil, map[string]interface{}{"key": testKey, "path": Path})
+	if err != b.ErrWrongKey {
+		t.Fatalf("expected ErrWrongKey for removed key, got %v", err)
+	}
+	reopen(t, b, map[string]interface{}{"key": otherKey[:], "path": Path})
+}
+
+func testPassphrase(t *testing.T, b Backend) {
+	// cheap enough for tests; real stores use keys.NewKDFParams
+	kdf := keys.KDFParams{Algorithm: keys.KDFArgon2id, Time: 1, Memory: 64, Threads: 1}
+	reopen(t, b, map[string]interface{}{"passphrase": "correct horse", "kdf": kdf, "path": Path})
+
+	_, err := b.New(nil, map[string]interface{}{"passphrase": "wrong", "path": Path})
+	if err != b.ErrWrongKey {
+		t.Fatalf("expected ErrWrongKey, got %v", err)
+	}
+	reopen(t, b, map[string]interface{}{"passphrase": "correct horse", "path": Path})
+}
+
+func testRawKeyRejectsPassphrase(t *testing.T, b Backend) {
+	closeStore(t, Open(t, b, nil))
+
+	_, err := b.New(nil, map[string]interface{}{"passphrase": "correct horse", "path": Path})
+	if err != b.ErrNoPassphrase {
+		t.Fatalf("expected ErrNoPassphrase, got %v", err)
+	}
+}
+
+func testShortKey(t *testing.T, b Backend) {
+	_, err := b.New(nil, map[string]interface{}{"key": []byte("short"), "path": Path})
+	if err == nil {
+		t.Fatal("expected a short key to be rejected")
+	}
+}
+
+func testRefreshKey(t *testing.T, b Backend) {
+	current := [32]byte{'f', 'i', 'r', 's', 't'}
+	provider := keys.KeyFunc(func(keys.KDFParams) ([32]byte, error) {
+		return current, nil
+	})
+	s, err := b.New(nil, map[string]interface{}{"key_provider": provider, "path": Path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := current
+	current = [32]byte{'s', 'e', 'c', 'o', 'n', 'd'}
+	err = s.(keyStore).RefreshKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeStore(t, s)
+
+	_, err = b.New(nil, map[string]interface{}{"key": first[:], "path": Path})
+	if err != b.ErrWrongKey {
+		t.Fatalf("expected ErrWrongKey for the replaced key, got %v", err)
+	}
+	reopen(t, b, map[string]interface{}{"key_provider": provider, "path": Path})
+}
+
+func testTenantsHaveDistinctKeys(t *testing.T, b Backend) {
+	master := []byte("testtesttesttesttesttesttesttest")
+	reopen(t, b, map[string]interface{}{"key": master, "tenant": "1", "path": Path})
+
+	for _, config := range []map[string]interface{}{
+		{"key": master, "tenant": "2", "path": Path},
+		{"key": master, "path": Path},
+	} {
+		_, err := b.New(nil, config)
+		if err != b.ErrWrongKey {
+			t.Fatalf("expected ErrWrongKey, got %v", err)
+		}
+	}
+	reopen(t, b, map[string]interface{}{"key": master, "tenant": "1", "path": Path})
+}
+
+func testOpenFromShares(t *testing.T, b Backend) {
+	key := []byte("testtesttesttesttesttesttesttest")
+	shares, err := keys.Split(key, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopen(t, b, map[string]interface{}{"key": key, "path": Path})
+	reopen(t, b, map[string]interface{}{"key_shares": [][]byte{shares[2], shares[0]}, "path": Path})
+}
+
+func testRotateDataKey(t *testing.T, b Backend) {
+	s := Open(t, b, nil)
+	Set(t, s, "a", "1")
+	err := s.(keyStore).RotateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Set(t, s, "b", "2")
+	err = s.(keyStore).RetireDataKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeStore(t, s)
+
+	s = Open(t, b, nil)
+	defer closeStore(t, s)
+	r, err := s.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for k, want := range map[string]string{"a": "1", "b": "2"} {
+		v, err := r.Get([]byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != want {
+			t.Fatalf("expected %s for %s, got %s", want, k, v)
+		}
+	}
+}
+
+func testVerify(t *testing.T, b Backend) {
+	s := Open(t, b, nil)
+	Set(t, s, "k", "v")
+	closeStore(t, s)
+
+	ok, err := b.Verify(map[string]interface{}{"key": testKey, "path": Path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected an intact store")
+	}
+}
+
+func testReadOnly(t *testing.T, b Backend) {
+	config := map[string]interface{}{"key": testKey, "path": Path, "read_only": true}
+	_, err := b.New(nil, config)
+	if err == nil {
+		t.Fatal("expected a missing store to be an error")
+	}
+	config["read_only"] = false
+	config["create_if_missing"] = false
+	_, err = b.New(nil, config)
+	if err == nil {
+		t.Fatal("expected a missing store to be an error")
+	}
+	os.RemoveAll(Path)
+
+	s := Open(t, b, nil)
+	Set(t, s, "k", "v")
+	closeStore(t, s)
+
+	config["read_only"] = true
+	s, err = b.New(nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := r.Get([]byte("k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "v" {
+		t.Fatalf("expected v, got %s", v)
+	}
+	r.Close()
+	_, err = s.Writer()
+	if err != b.ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly from Writer, got %v", err)
+	}
+	err = s.(keyStore).AddKey([32]byte{1})
+	if err != b.ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly from AddKey, got %v", err)
+	}
+	err = s.(keyStore).RotateDataKey()
+	if err != b.ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly from RotateDataKey, got %v", err)
+	}
+	closeStore(t, s)
+
+	config["read_only"] = false
+	config["error_if_exists"] = true
+	_, err = b.New(nil, config)
+	if err == nil {
+		t.Fatal("expected an existing store to be an error")
+	}
+}
@@ -0,0 +1,30 @@
+package suite
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// CommitmentSize is the size of a key commitment
+const CommitmentSize = sha256.Size
+
+// Commit returns a commitment to key for the message sealed with nonce.
+// None of the suites are key-committing on their own: a ciphertext can be
+// crafted that authenticates under two different keys. Storing the
+// commitment alongside the ciphertext, and checking it with VerifyCommitment
+// before opening, means a message only opens under the key it was sealed
+// with.
+func Commit(key, nonce []byte) [CommitmentSize]byte {
+	var rv [CommitmentSize]byte
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("fresnel key commitment"))
+	mac.Write(nonce)
+	copy(rv[:], mac.Sum(nil))
+	return rv
+}
+
+// VerifyCommitment reports whether commitment was made to key for nonce
+func VerifyCommitment(key, nonce, commitment []byte) bool {
+	expected := Commit(key, nonce)
+	return hmac.Equal(expected[:], commitment)
+}
@@ -0,0 +1,269 @@
+package suite
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Sizes for AES-GCM-SIV, as specified in RFC 8452
+const (
+	GCMSIVNonceSize = 12
+	GCMSIVTagSize   = 16
+)
+
+// maxGCMSIVInput is the longest plaintext or additional data RFC 8452 allows
+const maxGCMSIVInput = 1 << 36
+
+var errOpen = errors.New("cipher: message authentication failed")
+
+// gcmSIV implements AEAD_AES_128_GCM_SIV and AEAD_AES_256_GCM_SIV from RFC
+// 8452. Every message derives its own authentication and encryption keys from
+// the key-generating key and the nonce, and the synthetic IV is computed over
+// the whole plaintext, so repeating a nonce only reveals whether two messages
+// were identical.
+type gcmSIV struct {
+	kgk    cipher.Block // key-generating key
+	keyLen int
+}
+
+// NewGCMSIV returns AES-GCM-SIV keyed with a 16 or 32 byte key
+func NewGCMSIV(key []byte) (cipher.AEAD, error) {
+	if len(key) != 16 && len(key) != 32 {
+		return nil, fmt.Errorf("aes-gcm-siv: bad key length %d", len(key))
+	}
+	kgk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmSIV{kgk: kgk, keyLen: len(key)}, nil
+}
+
+func (g *gcmSIV) NonceSize() int { return GCMSIVNonceSize }
+func (g *gcmSIV) Overhead() int  { return GCMSIVTagSize }
+
+// deriveKeys returns the per-message authentication key and encryption key
+func (g *gcmSIV) deriveKeys(nonce []byte) (auth [16]byte, enc []byte) {
+	var in, out [16]byte
+	copy(in[4:], nonce)
+	derived := make([]byte, 0, 16+g.keyLen)
+	for i := uint32(0); len(derived) < cap(derived); i++ {
+		binary.LittleEndian.PutUint32(in[:4], i)
+		g.kgk.Encrypt(out[:], in[:])
+		derived = append(derived, out[:8]...)
+	}
+	copy(auth[:], derived[:16])
+	return auth, derived[16:]
+}
+
+// tag computes the synthetic IV, which is also the authentication tag
+func tag(enc cipher.Block, auth [16]byte, nonce, plaintext, additionalData []byte) [16]byte {
+	s := polyval(auth, additionalData, plaintext)
+	for i := range nonce {
+		s[i] ^= nonce[i]
+	}
+	s[15] &= 0x7f
+	enc.Encrypt(s[:], s[:])
+	return s
+}
+
+// ctr xors in with the keystream starting from the tag, whose top bit is set
+// and whose first four bytes are a little-endian block counter
+func ctr(enc cipher.Block, tag [16]byte, out, in []byte) {
+	block := tag
+	block[15] |= 0x80
+	var ks [16]byte
+	for len(in) > 0 {
+		enc.Encrypt(ks[:], block[:])
+		n := len(in)
+		if n > len(ks) {
+			n = len(ks)
+		}
+		for i := 0; i < n; i++ {
+			out[i] = in[i] ^ ks[i]
+		}
+		out, in = out[n:], in[n:]
+		binary.LittleEndian.PutUint32(block[:4], binary.LittleEndian.Uint32(block[:4])+1)
+	}
+}
+
+func (g *gcmSIV) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != GCMSIVNonceSize {
+		panic("aes-gcm-siv: incorrect nonce length")
+	}
+	if uint64(len(plaintext)) > maxGCMSIVInput || uint64(len(additionalData)) > maxGCMSIVInput {
+		panic("aes-gcm-siv: message too large")
+	}
+	auth, encKey := g.deriveKeys(nonce)
+	enc, err := aes.NewCipher(encKey)
+	wipe(encKey)
+	if err != nil {
+		panic(err)
+	}
+	t := tag(enc, auth, nonce, plaintext, additionalData)
+	ret, out := sliceForAppend(dst, len(plaintext)+GCMSIVTagSize)
+	ctr(enc, t, out, plaintext)
+	copy(out[len(plaintext):], t[:])
+	return ret
+}
+
+func (g *gcmSIV) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != GCMSIVNonceSize {
+		panic("aes-gcm-siv: incorrect nonce length")
+	}
+	if len(ciphertext) < GCMSIVTagSize ||
+		uint64(len(ciphertext)) > maxGCMSIVInput+GCMSIVTagSize ||
+		uint64(len(additionalData)) > maxGCMSIVInput {
+		return nil, errOpen
+	}
+	var t [16]byte
+	copy(t[:], ciphertext[len(ciphertext)-GCMSIVTagSize:])
+	ciphertext = ciphertext[:len(ciphertext)-GCMSIVTagSize]
+
+	auth, encKey := g.deriveKeys(nonce)
+	enc, err := aes.NewCipher(encKey)
+	wipe(encKey)
+	if err != nil {
+		return nil, err
+	}
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	ctr(enc, t, out, ciphertext)
+	expected := tag(enc, auth, nonce, out, additionalData)
+	if subtle.ConstantTimeCompare(expected[:], t[:]) != 1 {
+		wipe(out)
+		return nil, errOpen
+	}
+	return ret, nil
+}
+
+// polyval computes POLYVAL over the padded additional data, the padded
+// plaintext and their lengths in bits
+func polyval(h [16]byte, additionalData, plaintext []byte) [16]byte {
+	p := newPolyval(h)
+	p.update(additionalData)
+	p.update(plaintext)
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[:8], uint64(len(additionalData))*8)
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(plaintext))*8)
+	p.update(lengths[:])
+	return p.sum()
+}
+
+// fieldElement is an element of GF(2^128) in POLYVAL's little-endian
+// representation: bit i of the 128-bit little-endian integer lo|hi<<64 is
+// the coefficient of x^i.
+type fieldElement struct {
+	lo, hi uint64
+}
+
+func loadElement(b []byte) fieldElement {
+	return fieldElement{binary.LittleEndian.Uint64(b[:8]), binary.LittleEndian.Uint64(b[8:16])}
+}
+
+// The field polynomial x^128 + x^127 + x^126 + x^121 + 1 without its leading
+// term, for reducing after a multiplication by x
+const polyHi = 1<<63 | 1<<62 | 1<<57
+
+// mulX multiplies by x
+func (a fieldElement) mulX() fieldElement {
+	carry := a.hi >> 63
+	a.hi = a.hi<<1 | a.lo>>63
+	a.lo <<= 1
+	if carry != 0 {
+		a.hi ^= polyHi
+		a.lo ^= 1
+	}
+	return a
+}
+
+// divX multiplies by x^-1, which is x^127 + x^126 + x^125 + x^120
+func (a fieldElement) divX() fieldElement {
+	odd := a.lo & 1
+	a.lo = a.lo>>1 | a.hi<<63
+	a.hi >>= 1
+	if odd != 0 {
+		a.hi ^= 1<<63 | 1<<62 | 1<<61 | 1<<56
+	}
+	return a
+}
+
+// polyvalState accumulates S_j = dot(S_{j-1} + X_j, H), where dot(a, b) is
+// a * b * x^-128. It multiplies by the precomputed powers H * x^(i-128).
+type polyvalState struct {
+	powers [128]fieldElement
+	s      fieldElement
+}
+
+func newPolyval(h [16]byte) *polyvalState {
+	p := &polyvalState{}
+	e := loadElement(h[:])
+	for i := 0; i < 128; i++ {
+		e = e.divX()
+	}
+	for i := range p.powers {
+		p.powers[i] = e
+		e = e.mulX()
+	}
+	return p
+}
+
+// update absorbs b, zero padded to a whole number of blocks
+func (p *polyvalState) update(b []byte) {
+	var block [16]byte
+	for len(b) > 0 {
+		n := copy(block[:], b)
+		for i := n; i < 16; i++ {
+			block[i] = 0
+		}
+		b = b[n:]
+		x := loadElement(block[:])
+		p.s.lo ^= x.lo
+		p.s.hi ^= x.hi
+		p.mul()
+	}
+}
+
+// mul replaces s with dot(s, H)
+func (p *polyvalState) mul() {
+	var r fieldElement
+	for i := 0; i < 64; i++ {
+		mask := -(p.s.lo >> uint(i) & 1)
+		r.lo ^= p.powers[i].lo & mask
+		r.hi ^= p.powers[i].hi & mask
+	}
+	for i := 0; i < 64; i++ {
+		mask := -(p.s.hi >> uint(i) & 1)
+		r.lo ^= p.powers[64+i].lo & mask
+		r.hi ^= p.powers[64+i].hi & mask
+	}
+	p.s = r
+}
+
+func (p *polyvalState) sum() [16]byte {
+	var rv [16]byte
+	binary.LittleEndian.PutUint64(rv[:8], p.s.lo)
+	binary.LittleEndian.PutUint64(rv[8:], p.s.hi)
+	return rv
+}
+
+// sliceForAppend extends in by n bytes, returning the whole slice and the
+// extension
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,218 @@
+package suite
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// From RFC 8452, Appendix A
+func TestPolyval(t *testing.T) {
+	var h [16]byte
+	copy(h[:], decodeHex(t, "25629347589242761d31f826ba4b757b"))
+	p := newPolyval(h)
+	p.update(decodeHex(t, "4f4f95668c83dfb6401762bb2d01a262"))
+	p.update(decodeHex(t, "d1a24ddd2721d006bbe45f20d3c9f362"))
+	sum := p.sum()
+	if hex.EncodeToString(sum[:]) != "f7a3b47b846119fae5b7866cf5e5b77e" {
+		t.Fatalf("unexpected POLYVAL %x", sum)
+	}
+}
+
+// From RFC 8452, Appendix C
+var gcmSIVVectors = []struct {
+	key, nonce, plaintext, ad, result string
+}{
+	// AEAD_AES_128_GCM_SIV
+	{
+		key:    "01000000000000000000000000000000",
+		nonce:  "030000000000000000000000",
+		result: "dc20e2d83f25705bb49e439eca56de25",
+	},
+	{
+		key:       "01000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "0100000000000000",
+		result:    "b5d839330ac7b786578782fff6013b815b287c22493a364c",
+	},
+	// AEAD_AES_256_GCM_SIV
+	{
+		key:    "0100000000000000000000000000000000000000000000000000000000000000",
+		nonce:  "030000000000000000000000",
+		result: "07f5f4169bbf55a8400cd47ea6fd400f",
+	},
+	{
+		key:       "0100000000000000000000000000000000000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "0100000000000000",
+		result:    "c2ef328e5c71c83b843122130f7364b761e0b97427e3df28",
+	},
+	{
+		key:       "0100000000000000000000000000000000000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "010000000000000000000000",
+		result:    "9aab2aeb3faa0a34aea8e2b18ca50da9ae6559e48fd10f6e5c9ca17e",
+	},
+	{
+		key:       "0100000000000000000000000000000000000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "01000000000000000000000000000000",
+		result:    "85a01b63025ba19b7fd3ddfc033b3e76c9eac6fa700942702e90862383c6c366",
+	},
+	{
+		key:       "0100000000000000000000000000000000000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "0100000000000000000000000000000002000000000000000000000000000000",
+		result:    "4a6a9db4c8c6549201b9edb53006cba821ec9cf850948a7c86c68ac7539d027fe819e63abcd020b006a976397632eb5d",
+	},
+	{
+		key:       "0100000000000000000000000000000000000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "010000000000000000000000000000000200000000000000000000000000000003000000000000000000000000000000",
+		result:    "c00d121893a9fa603f48ccc1ca3c57ce7499245ea0046db16c53c7c66fe717e39cf6c748837b61f6ee3adcee17534ed5790bc96880a99ba804bd12c0e6a22cc4",
+	},
+	{
+		key:       "0100000000000000000000000000000000000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "01000000000000000000000000000000020000000000000000000000000000000300000000000000000000000000000004000000000000000000000000000000",
+		result:    "c2d5160a1f8683834910acdafc41fbb1632d4a353e8b905ec9a5499ac34f96c7e1049eb080883891a4db8caaa1f99dd004d80487540735234e3744512c6f90ce112864c269fc0d9d88c61fa47e39aa08",
+	},
+	{
+		key:       "0100000000000000000000000000000000000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "0200000000000000",
+		ad:        "01",
+		result:    "1de22967237a813291213f267e3b452f02d01ae33e4ec854",
+	},
+	{
+		key:       "0100000000000000000000000000000000000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "020000000000000000000000",
+		ad:        "01",
+		result:    "163d6f9cc1b346cd453a2e4cc1a4a19ae800941ccdc57cc8413c277f",
+	},
+	{
+		key:       "0100000000000000000000000000000000000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "02000000000000000000000000000000",
+		ad:        "01",
+		result:    "c91545823cc24f17dbb0e9e807d5ec17b292d28ff61189e8e49f3875ef91aff7",
+	},
+	{
+		key:       "0100000000000000000000000000000000000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "0200000000000000000000000000000003000000000000000000000000000000",
+		ad:        "01",
+		result:    "07dad364bfc2b9da89116d7bef6daaaf6f255510aa654f920ac81b94e8bad365aea1bad12702e1965604374aab96dbbc",
+	},
+	{
+		key:       "0100000000000000000000000000000000000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "020000000000000000000000000000000300000000000000000000000000000004000000000000000000000000000000",
+		ad:        "01",
+		result:    "c67a1f0f567a5198aa1fcc8e3f21314336f7f51ca8b1af61feac35a86416fa47fbca3b5f749cdf564527f2314f42fe2503332742b228c647173616cfd44c54eb",
+	},
+	{
+		key:       "0100000000000000000000000000000000000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "02000000000000000000000000000000030000000000000000000000000000000400000000000000000000000000000005000000000000000000000000000000",
+		ad:        "01",
+		result:    "67fd45e126bfb9a79930c43aad2d36967d3f0e4d217c1e551f59727870beefc98cb933a8fce9de887b1e40799988db1fc3f91880ed405b2dd298318858467c895bde0285037c5de81e5b570a049b62a0",
+	},
+	{
+		key:       "0100000000000000000000000000000000000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "02000000",
+		ad:        "010000000000000000000000",
+		result:    "22b3f4cd1835e517741dfddccfa07fa4661b74cf",
+	},
+	{
+		key:       "0100000000000000000000000000000000000000000000000000000000000000",
+		nonce:     "030000000000000000000000",
+		plaintext: "0300000000000000000000000000000004000000",
+		ad:        "010000000000000000000000000000000200",
+		result:    "43dd0163cdb48f9fe3212bf61b201976067f342bb879ad976d8242acc188ab59cabfe307",
+	},
+	{
+		key:    "e66021d5eb8e4f4066d4adb9c33560e4f46e44bb3da0015c94f7088736864200",
+		nonce:  "e0eaf5284d884a0e77d31646",
+		result: "169fbb2fbf389a995f6390af22228a62",
+	},
+	{
+		key:       "bae8e37fc83441b16034566b7a806c46bb91c3c5aedb64a6c590bc84d1a5e269",
+		nonce:     "e4b47801afc0577e34699b9e",
+		plaintext: "671fdd",
+		ad:        "4fbdc66f14",
+		result:    "0eaccb93da9bb81333aee0c785b240d319719d",
+	},
+	{
+		key:       "6545fc880c94a95198874296d5cc1fd161320b6920ce07787f86743b275d1ab3",
+		nonce:     "2f6d1f0434d8848c1177441f",
+		plaintext: "195495860f04",
+		ad:        "6787f3ea22c127aaf195",
+		result:    "a254dad4f3f96b62b84dc40c84636a5ec12020ec8c2c",
+	},
+	{
+		key:       "d1894728b3fed1473c528b8426a582995929a1499e9ad8780c8d63d0ab4149c0",
+		nonce:     "9f572c614b4745914474e7c7",
+		plaintext: "c9882e5386fd9f92ec",
+		ad:        "489c8fde2be2cf97e74e932d4ed87d",
+		result:    "0df9e308678244c44bc0fd3dc6628dfe55ebb0b9fb2295c8c2",
+	},
+	{
+		key:       "a44102952ef94b02b805249bac80e6f61455bfac8308a2d40d8c845117808235",
+		nonce:     "5c9e940fea2f582950a70d5a",
+		plaintext: "1db2316fd568378da107b52b",
+		ad:        "0da55210cc1c1b0abde3b2f204d1e9f8b06bc47f",
+		result:    "8dbeb9f7255bf5769dd56692404099c2587f64979f21826706d497d5",
+	},
+	{
+		key:       "9745b3d1ae06556fb6aa7890bebc18fe6b3db4da3d57aa94842b9803a96e07fb",
+		nonce:     "6de71860f762ebfbd08284e4",
+		plaintext: "21702de0de18baa9c9596291b08466",
+		ad:        "f37de21c7ff901cfe8a69615a93fdf7a98cad481796245709f",
+		result:    "793576dfa5c0f88729a7ed3c2f1bffb3080d28f6ebb5d3648ce97bd5ba67fd",
+	},
+	// AEAD_AES_256_GCM_SIV counter wrap, from Appendix C.3
+	{
+		key:       "0000000000000000000000000000000000000000000000000000000000000000",
+		nonce:     "000000000000000000000000",
+		plaintext: "000000000000000000000000000000004db923dc793ee6497c76dcc03a98e108",
+		result:    "f3f80f2cf0cb2dd9c5984fcda908456cc537703b5ba70324a6793a7bf218d3eaffffffff000000000000000000000000",
+	},
+	{
+		key:       "0000000000000000000000000000000000000000000000000000000000000000",
+		nonce:     "000000000000000000000000",
+		plaintext: "eb3640277c7ffd1303c7a542d02d3e4c0000000000000000",
+		result:    "18ce4f0b8cb4d0cac65fea8f79257b20888e53e72299e56dffffffff000000000000000000000000",
+	},
+}
+
+func TestGCMSIVVectors(t *testing.T) {
+	for i, v := range gcmSIVVectors {
+		aead, err := NewGCMSIV(decodeHex(t, v.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce, plaintext, ad := decodeHex(t, v.nonce), decodeHex(t, v.plaintext), decodeHex(t, v.ad)
+		sealed := aead.Seal(nil, nonce, plaintext, ad)
+		if hex.EncodeToString(sealed) != v.result {
+			t.Fatalf("vector %d: expected %s, got %x", i, v.result, sealed)
+		}
+		opened, err := aead.Open(nil, nonce, sealed, ad)
+		if err != nil {
+			t.Fatalf("vector %d: %v", i, err)
+		}
+		if !bytes.Equal(opened, plaintext) {
+			t.Fatalf("vector %d: expected %x, got %x", i, plaintext, opened)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Package suite provides the AEAD cipher suites that pages and batches can be
+// sealed with. A file or store records the ID of its suite when it is
+// created, and is always opened with that suite.
+package suite
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Suite is an AEAD construction keyed with a 32 byte key
+type Suite interface {
+	// ID identifies the suite in file headers and store metadata
+	ID() uint16
+	// String is the suite's name, as accepted by Parse
+	String() string
+	// New returns the AEAD for key
+	New(key []byte) (cipher.AEAD, error)
+}
+
+// Cipher suites. XChaCha20-Poly1305 is the default. AES-256-GCM is
+// FIPS-approved and fastest where the CPU has AES instructions, but its
+// random 96-bit nonces limit a single key to about 2^32 messages, so keys
+// should be rotated well before then. AES-256-GCM-SIV tolerates repeated
+// nonces, at the cost of two passes over each message.
+var (
+	XChaCha20Poly1305 Suite = xchacha{}
+	AES256GCM         Suite = aesGCM{}
+	AES256GCMSIV      Suite = aesGCMSIV{}
+)
+
+// Default is the suite new files and stores use unless told otherwise
+var Default = XChaCha20Poly1305
+
+var all = []Suite{XChaCha20Poly1305, AES256GCM, AES256GCMSIV}
+
+// ByID returns the suite recorded as id
+func ByID(id uint16) (Suite, error) {
+	for _, s := range all {
+		if s.ID() == id {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported cipher suite %d", id)
+}
+
+// Parse returns the suite named name
+func Parse(name string) (Suite, error) {
+	for _, s := range all {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown cipher suite %q", name)
+}
+
+type xchacha struct{}
+
+func (xchacha) ID() uint16     { return 1 }
+func (xchacha) String() string { return "xchacha20-poly1305" }
+
+func (xchacha) New(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.NewX(key)
+}
+
+type aesGCM struct{}
+
+func (aesGCM) ID() uint16     { return 2 }
+func (aesGCM) String() string { return "aes-256-gcm" }
+
+func (aesGCM) New(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("aes-256-gcm: bad key length %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type aesGCMSIV struct{}
+
+func (aesGCMSIV) ID() uint16     { return 3 }
+func (aesGCMSIV) String() string { return "aes-256-gcm-siv" }
+
+func (aesGCMSIV) New(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("aes-256-gcm-siv: bad key length %d", len(key))
+	}
+	return NewGCMSIV(key)
+}
@@ -0,0 +1,74 @@
+package suite
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestSuitesRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := bytes.Repeat([]byte("patient record "), 100)
+	for _, s := range all {
+		byID, err := ByID(s.ID())
+		if err != nil || byID != s {
+			t.Fatalf("%s: expected ByID to find the suite, got %v", s, err)
+		}
+		parsed, err := Parse(s.String())
+		if err != nil || parsed != s {
+			t.Fatalf("%s: expected Parse to find the suite, got %v", s, err)
+		}
+		aead, err := s.New(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce := make([]byte, aead.NonceSize())
+		sealed := aead.Seal(nil, nonce, plaintext, []byte("ad"))
+		opened, err := aead.Open(nil, nonce, sealed, []byte("ad"))
+		if err != nil || !bytes.Equal(opened, plaintext) {
+			t.Fatalf("%s: round trip failed: %v", s, err)
+		}
+		sealed[len(sealed)/2] ^= 1
+		_, err = aead.Open(nil, nonce, sealed, []byte("ad"))
+		if err == nil {
+			t.Fatalf("%s: expected a tampered message to fail authentication", s)
+		}
+		sealed[len(sealed)/2] ^= 1
+		_, err = aead.Open(nil, nonce, sealed, []byte("other"))
+		if err == nil {
+			t.Fatalf("%s: expected the wrong additional data to fail authentication", s)
+		}
+	}
+}
+
+func TestUnknownSuite(t *testing.T) {
+	_, err := ByID(0)
+	if err == nil {
+		t.Fatal("expected an unknown suite ID to be rejected")
+	}
+	_, err = Parse("rot13")
+	if err == nil {
+		t.Fatal("expected an unknown suite name to be rejected")
+	}
+}
+
+func TestCommitment(t *testing.T) {
+	key, other := make([]byte, 32), make([]byte, 32)
+	other[0] = 1
+	nonce := []byte("nonce")
+	c := Commit(key, nonce)
+	if !VerifyCommitment(key, nonce, c[:]) {
+		t.Fatal("expected the commitment to verify")
+	}
+	if VerifyCommitment(other, nonce, c[:]) {
+		t.Fatal("expected the commitment to reject another key")
+	}
+	if VerifyCommitment(key, []byte("other"), c[:]) {
+		t.Fatal("expected the commitment to reject another nonce")
+	}
+}